@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed update request
+const (
+	SignatureHeader = "X-Update-Signature"
+	TimestampHeader = "X-Update-Timestamp"
+	NonceHeader     = "X-Update-Nonce"
+)
+
+// SignatureMaxAge is how far a signed request's timestamp may be from the
+// updater's clock
+var SignatureMaxAge = 5 * time.Minute
+
+// Verifier checks the signatures of update requests. Each nonce is only
+// accepted once while its timestamp is valid, so a captured request can't
+// be replayed.
+type Verifier struct {
+	secret []byte
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// seen holds the nonces accepted within maxAge, with their timestamps
+	seen map[string]time.Time
+}
+
+// NewVerifier creates a Verifier for requests signed with secret
+func NewVerifier(secret string, maxAge time.Duration) *Verifier {
+	return &Verifier{
+		secret: []byte(secret),
+		maxAge: maxAge,
+		now:    time.Now,
+		seen:   map[string]time.Time{},
+	}
+}
+
+// Verify checks the signature of a request with body
+func (v *Verifier) Verify(r *http.Request, body []byte) error {
+	signature := strings.TrimPrefix(r.Header.Get(SignatureHeader), "v1=")
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return errors.New("request isn't signed")
+	}
+	expected := Signature(string(v.secret), timestamp, nonce, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	signed := time.Unix(unix, 0)
+	now := v.now()
+	if signed.Before(now.Add(-v.maxAge)) || signed.After(now.Add(v.maxAge)) {
+		return errors.New("signature expired")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for n, t := range v.seen {
+		if t.Before(now.Add(-v.maxAge)) {
+			delete(v.seen, n)
+		}
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return errors.New("request replayed")
+	}
+	v.seen[nonce] = signed
+	return nil
+}
+
+// Signature returns the hex HMAC-SHA256 of a request's signed fields
+func Signature(secret, timestamp, nonce, method, uri string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range []string{timestamp, nonce, method, uri, hex.EncodeToString(digest[:])} {
+		mac.Write([]byte(field))
+		mac.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RequireSignature rejects requests to next that aren't signed by v.
+// Requests pass through unchecked when v is nil.
+func RequireSignature(v *Verifier, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v == nil {
+			next(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxUpdateSize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := v.Verify(r, body); err != nil {
+			log.Printf("Rejected request from %s: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	// The uploader signs requests with the same vector
+	got := Signature("secret", "1600000000", "nonce", "POST", "/update?wait=true", []byte(`{"added":["photos/a"]}`))
+	if expected := "0f0aa2de89dc2529a8ec83866becc6d1ebcf2b4b3c6d8168ed79c872cb1e5489"; got != expected {
+		t.Errorf("unexpected signature: got %s want %s", got, expected)
+	}
+}
+
+func TestRequireSignature(t *testing.T) {
+
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	v := NewVerifier("secret", 5*time.Minute)
+	v.now = func() time.Time { return now }
+	var calls int
+	handler := RequireSignature(v, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+
+	signed := func(secret, nonce string, at time.Time, body, sent string) *http.Request {
+		req, _ := http.NewRequest("POST", "/update", strings.NewReader(sent))
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(NonceHeader, nonce)
+		req.Header.Set(SignatureHeader, "v1="+Signature(secret, timestamp, nonce, "POST", "/update", []byte(body)))
+		return req
+	}
+	body := `{"added": ["photos/a"]}`
+	unsigned, _ := http.NewRequest("POST", "/update", strings.NewReader(body))
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"signed", signed("secret", "a", now, body, body), http.StatusOK},
+		{"replayed", signed("secret", "a", now, body, body), http.StatusUnauthorized},
+		{"unsigned", unsigned, http.StatusUnauthorized},
+		{"wrong secret", signed("guess", "b", now, body, body), http.StatusUnauthorized},
+		{"tampered body", signed("secret", "c", now, body, `{"full": true}`), http.StatusUnauthorized},
+		{"expired", signed("secret", "d", now.Add(-time.Hour), body, body), http.StatusUnauthorized},
+		{"skewed", signed("secret", "e", now.Add(time.Minute), body, body), http.StatusOK},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		handler(rr, test.req)
+		if rr.Code != test.status {
+			t.Errorf("%s request: got status %d want %d", test.name, rr.Code, test.status)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// Build states
+const (
+	BuildQueued    = "queued"
+	BuildRunning   = "running"
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+	BuildCanceled  = "canceled"
+)
+
+// BuildHistorySize is how many builds the Builder remembers
+var BuildHistorySize = 100
+
+// Build is a record of a gallery build
+type Build struct {
+	ID string `json:"id"`
+	// Triggers lists the sources of the update requests this build covers
+	Triggers []string `json:"triggers"`
+	// Changes are the photo changes the build applies
+	Changes  *Changes   `json:"changes,omitempty"`
+	Status   string     `json:"status"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Release  string     `json:"release,omitempty"`
+	// Preview is the URL to review the release at before promoting it
+	Preview string `json:"preview,omitempty"`
+	Photos  int    `json:"photos"`
+	// Sync describes what the build changed in the site bucket
+	Sync    *SyncReport   `json:"sync,omitempty"`
+	Metrics *BuildMetrics `json:"metrics,omitempty"`
+	Stdout  string        `json:"stdout,omitempty"`
+	Stderr  string        `json:"stderr,omitempty"`
+	Error   string        `json:"error,omitempty"`
+
+	done chan struct{}
+}
+
+// BuildResult is what a build function reports about its build
+type BuildResult struct {
+	// Release is the site release the build published
+	Release string
+	// Preview is the URL of the release, if it was published for preview
+	Preview string
+	Photos  int
+	Sync    *SyncReport
+	Metrics *BuildMetrics
+	Stdout  string
+	Stderr  string
+}
+
+// BuildMetrics describes where a build spent its time
+type BuildMetrics struct {
+	// Stages holds how long each stage of the build took, in seconds
+	Stages map[string]float64 `json:"stages"`
+	// Metadata counts where the photos' metadata came from, when it was read from the bucket
+	Metadata *FetchStats `json:"metadata,omitempty"`
+}
+
+// NewBuildMetrics creates empty build metrics
+func NewBuildMetrics() *BuildMetrics {
+	return &BuildMetrics{Stages: map[string]float64{}}
+}
+
+// Time records that a stage that began at start has finished
+func (m *BuildMetrics) Time(stage string, start time.Time) {
+	m.Stages[stage] = time.Since(start).Seconds()
+}
+
+// Builder serializes gallery builds. Triggers that arrive while a build is
+// running are coalesced into a single follow-up build, and a build only
+// starts once no trigger has arrived for the debounce window, so a burst
+// of uploads results in one build. A running build is canceled when a
+// trigger arrives, since the follow-up build supersedes it, but the build
+// after a canceled one always runs to completion, so a steady stream of
+// triggers can't keep the site from being published. The changes of a
+// build that doesn't succeed are carried over to the next one.
+type Builder struct {
+	build    func(ctx context.Context, id string, changes *Changes) (*BuildResult, error)
+	debounce time.Duration
+
+	mu      sync.Mutex
+	running bool
+	// cancel cancels the running build. It's nil when the build can't be canceled.
+	cancel context.CancelFunc
+	// superseded is set when a build was canceled, so the next one isn't
+	superseded  bool
+	lastTrigger time.Time
+	// pending is the build that covers the queued triggers
+	pending *Build
+	// unapplied holds the changes of failed and canceled builds
+	unapplied *Changes
+	history   []*Build
+	builds    map[string]*Build
+}
+
+// NewBuilder creates a Builder that runs build
+func NewBuilder(build func(ctx context.Context, id string, changes *Changes) (*BuildResult, error), debounce time.Duration) *Builder {
+	return &Builder{
+		build:    build,
+		debounce: debounce,
+		builds:   map[string]*Build{},
+	}
+}
+
+// Trigger queues a build requested by source to apply changes, or to
+// rebuild everything when changes is nil. It returns the ID of the build
+// that will cover the request, which may be shared with other triggers.
+func (b *Builder) Trigger(source string, changes *Changes) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastTrigger = time.Now()
+	if b.pending == nil {
+		b.pending = &Build{
+			ID:     xid.New().String(),
+			Status: BuildQueued,
+			Queued: b.lastTrigger.UTC(),
+			done:   make(chan struct{}),
+		}
+		b.remember(b.pending)
+	}
+	b.pending.Triggers = append(b.pending.Triggers, source)
+	if changes == nil {
+		changes = &Changes{Full: true}
+	}
+	if b.pending.Changes == nil {
+		b.pending.Changes = changes.Copy()
+	} else {
+		b.pending.Changes.Merge(changes)
+	}
+	if b.cancel != nil {
+		b.cancel()
+		b.cancel = nil
+		b.superseded = true
+	}
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	return b.pending.ID
+}
+
+// Wait blocks until a build completes and returns its record,
+// or false if the build isn't known
+func (b *Builder) Wait(id string) (Build, bool) {
+	b.mu.Lock()
+	build, ok := b.builds[id]
+	b.mu.Unlock()
+	if !ok {
+		return Build{}, false
+	}
+	<-build.done
+	return b.Get(id)
+}
+
+// Get returns a copy of a build record
+func (b *Builder) Get(id string) (Build, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	build, ok := b.builds[id]
+	if !ok {
+		return Build{}, false
+	}
+	return build.copy(), true
+}
+
+// List returns copies of the remembered builds, newest first
+func (b *Builder) List() []Build {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := make([]Build, 0, len(b.history))
+	for _, build := range b.history {
+		result = append(result, build.copy())
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Queued.After(result[j].Queued)
+	})
+	return result
+}
+
+// remember adds a build to the history, forgetting the oldest finished
+// builds. Must be called with b.mu held.
+func (b *Builder) remember(build *Build) {
+	b.history = append(b.history, build)
+	b.builds[build.ID] = build
+	for len(b.history) > BuildHistorySize && b.history[0].Finished != nil {
+		delete(b.builds, b.history[0].ID)
+		b.history = b.history[1:]
+	}
+}
+
+// run builds until no triggers are pending
+func (b *Builder) run() {
+	for {
+		b.mu.Lock()
+		// Wait for the triggers to settle
+		if wait := time.Until(b.lastTrigger.Add(b.debounce)); wait > 0 {
+			b.mu.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+		build := b.pending
+		if build == nil {
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+		b.pending = nil
+		if b.unapplied != nil {
+			changes := b.unapplied
+			changes.Merge(build.Changes)
+			build.Changes = changes
+			b.unapplied = nil
+		}
+		changes := build.Changes.Copy()
+		started := time.Now().UTC()
+		build.Started = &started
+		build.Status = BuildRunning
+		ctx, cancel := context.WithCancel(context.Background())
+		if b.superseded {
+			b.superseded = false
+		} else {
+			b.cancel = cancel
+		}
+		b.mu.Unlock()
+
+		log.Printf("Starting build %s..", build.ID)
+		result, err := b.build(ctx, build.ID, changes)
+
+		b.mu.Lock()
+		cancel()
+		b.cancel = nil
+		finished := time.Now().UTC()
+		build.Finished = &finished
+		build.Status = BuildSucceeded
+		if result != nil {
+			build.Release = result.Release
+			build.Preview = result.Preview
+			build.Photos = result.Photos
+			build.Sync = result.Sync
+			build.Metrics = result.Metrics
+			build.Stdout = result.Stdout
+			build.Stderr = result.Stderr
+		}
+		if err != nil {
+			build.Status = BuildFailed
+			build.Error = err.Error()
+		}
+		if errors.Is(err, context.Canceled) {
+			build.Status = BuildCanceled
+		}
+		if err != nil {
+			b.unapplied = build.Changes.Copy()
+		}
+		b.mu.Unlock()
+		log.Printf("Build %s %s in %s", build.ID, build.Status, finished.Sub(started))
+		close(build.done)
+	}
+}
+
+// copy returns a snapshot of a build record. Must be called with the
+// Builder's lock held.
+func (build *Build) copy() Build {
+	c := *build
+	c.Triggers = append([]string(nil), build.Triggers...)
+	if build.Changes != nil {
+		c.Changes = build.Changes.Copy()
+	}
+	return c
+}
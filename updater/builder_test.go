@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuilderCoalescesTriggers(t *testing.T) {
+
+	var builds, running int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	b := NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			t.Errorf("builds ran concurrently")
+		}
+		atomic.AddInt32(&builds, 1)
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return &BuildResult{Photos: 3}, nil
+	}, 0)
+
+	first := b.Trigger("first", nil)
+	<-started
+
+	// Triggers during a build are coalesced into one follow-up build
+	var wg sync.WaitGroup
+	ids := make([]string, 5)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = b.Trigger("follow-up", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id == first || id != ids[0] {
+			t.Fatalf("triggers during a build weren't coalesced: %v", ids)
+		}
+	}
+
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	build, ok := b.Wait(ids[0])
+	if !ok {
+		t.Fatalf("follow-up build %s not found", ids[0])
+	}
+
+	if n := atomic.LoadInt32(&builds); n != 2 {
+		t.Errorf("ran %d builds, want 2", n)
+	}
+	if build.Status != BuildSucceeded || build.Photos != 3 || len(build.Triggers) != 5 {
+		t.Errorf("unexpected build record: %+v", build)
+	}
+	if list := b.List(); len(list) != 2 || list[0].ID != ids[0] {
+		t.Errorf("unexpected build history: %+v", list)
+	}
+}
+
+func TestBuilderDebounce(t *testing.T) {
+
+	var builds int32
+	b := NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		atomic.AddInt32(&builds, 1)
+		return &BuildResult{}, nil
+	}, 50*time.Millisecond)
+
+	var id string
+	for i := 0; i < 5; i++ {
+		id = b.Trigger("test", nil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Wait(id)
+
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Errorf("ran %d builds, want 1", n)
+	}
+}
+
+func TestBuilderRecordsFailures(t *testing.T) {
+
+	b := NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		return &BuildResult{Stderr: "Error: template not found"}, errors.New("hugo failed")
+	}, 0)
+
+	build, _ := b.Wait(b.Trigger("test", nil))
+	if build.Status != BuildFailed || build.Error != "hugo failed" || build.Stderr == "" {
+		t.Errorf("unexpected build record: %+v", build)
+	}
+	if build.Started == nil || build.Finished == nil {
+		t.Errorf("build wasn't timed: %+v", build)
+	}
+}
+
+func TestBuilderCancelsSupersededBuilds(t *testing.T) {
+
+	started := make(chan struct{}, 2)
+	b := NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return &BuildResult{}, nil
+		}
+	}, 0)
+
+	first := b.Trigger("first", nil)
+	<-started
+	second := b.Trigger("second", nil)
+
+	if build, _ := b.Wait(first); build.Status != BuildCanceled {
+		t.Errorf("superseded build finished as %s", build.Status)
+	}
+	if build, _ := b.Wait(second); build.Status != BuildSucceeded {
+		t.Errorf("follow-up build finished as %s", build.Status)
+	}
+}
+
+func TestBuilderCompletesDuringSteadyTriggers(t *testing.T) {
+
+	b := NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+			return &BuildResult{}, nil
+		}
+	}, 0)
+
+	// Trigger faster than a build takes, as a watched directory being copied into does
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				b.Trigger("watch", &Changes{Added: []string{"photos/a"}})
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, build := range b.List() {
+			if build.Status == BuildSucceeded {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("no build completed while triggers kept arriving")
+}
+
+func TestBuilderCarriesOverUnappliedChanges(t *testing.T) {
+
+	var fail int32 = 1
+	applied := make(chan *Changes, 2)
+	b := NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		applied <- changes
+		if atomic.CompareAndSwapInt32(&fail, 1, 0) {
+			return nil, errors.New("hugo failed")
+		}
+		return &BuildResult{}, nil
+	}, 0)
+
+	b.Wait(b.Trigger("first", &Changes{Added: []string{"photos/a"}}))
+	build, _ := b.Wait(b.Trigger("second", &Changes{Deleted: []string{"photos/b"}}))
+
+	<-applied
+	changes := <-applied
+	if len(changes.Added) != 1 || len(changes.Deleted) != 1 || changes.Full {
+		t.Errorf("follow-up build didn't apply the failed build's changes: %+v", changes)
+	}
+	if build.Status != BuildSucceeded || len(build.Changes.Added) != 1 {
+		t.Errorf("unexpected build record: %+v", build)
+	}
+}
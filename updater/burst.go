@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// HashDistance returns the number of bits that differ between two perceptual hashes
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// NearDuplicateIndex finds photos with similar perceptual hashes
+type NearDuplicateIndex struct {
+	distance int
+	entries  []*Entry
+}
+
+// NewNearDuplicateIndex creates an index matching hashes at most distance bits apart
+func NewNearDuplicateIndex(distance int) *NearDuplicateIndex {
+	return &NearDuplicateIndex{distance: distance}
+}
+
+// Add adds an entry to the index. Entries without a hash are ignored.
+func (idx *NearDuplicateIndex) Add(e *Entry) {
+	if e.HasPHash {
+		idx.entries = append(idx.entries, e)
+	}
+}
+
+// Matches returns the indexed entries that are near-duplicates of e
+func (idx *NearDuplicateIndex) Matches(e *Entry) []*Entry {
+	var result []*Entry
+	if !e.HasPHash {
+		return result
+	}
+	for _, o := range idx.entries {
+		if o != e && HashDistance(o.PHash, e.PHash) <= idx.distance {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// CollapseBursts groups near-identical photos taken within window of each other
+// into a single entry. The best photo of each burst becomes its cover and the
+// others are moved to the cover's Burst. Entries keep their original order.
+func CollapseBursts(entries []*Entry, window time.Duration, distance int) []*Entry {
+	byTime := make([]*Entry, len(entries))
+	copy(byTime, entries)
+	sort.SliceStable(byTime, func(i, j int) bool {
+		return byTime[i].Taken.Before(byTime[j].Taken)
+	})
+
+	// Walk the photos in time order, adding each one to the burst of a
+	// near-duplicate taken shortly before it
+	burstOf := map[*Entry][]*Entry{}
+	leader := map[*Entry]*Entry{}
+	idx := NewNearDuplicateIndex(distance)
+	for _, e := range byTime {
+		if e.Kind != MediaKindImage {
+			continue
+		}
+		for _, o := range idx.Matches(e) {
+			if e.Taken.Sub(o.Taken) <= window {
+				leader[e] = leader[o]
+				break
+			}
+		}
+		if leader[e] == nil {
+			leader[e] = e
+		}
+		burstOf[leader[e]] = append(burstOf[leader[e]], e)
+		idx.Add(e)
+	}
+
+	result := []*Entry{}
+	for _, e := range entries {
+		burst, ok := burstOf[e]
+		if e.Kind == MediaKindImage && !ok {
+			// Part of another photo's burst
+			continue
+		}
+		if len(burst) < 2 {
+			result = append(result, e)
+			continue
+		}
+		cover := bestOf(burst)
+		cover.Burst = nil
+		for _, o := range burst {
+			if o != cover {
+				cover.Burst = append(cover.Burst, o)
+			}
+		}
+		result = append(result, cover)
+	}
+	return result
+}
+
+// bestOf picks the cover photo of a burst: the sharpest one, when the
+// uploader scored them. Otherwise larger files are assumed to hold more
+// detail, since blurry or dark JPEGs compress better.
+func bestOf(burst []*Entry) *Entry {
+	best := burst[0]
+	for _, e := range burst[1:] {
+		if e.Sharpness != best.Sharpness {
+			if e.Sharpness > best.Sharpness {
+				best = e
+			}
+			continue
+		}
+		if e.Size > best.Size {
+			best = e
+		}
+	}
+	return best
+}
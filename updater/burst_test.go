@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollapseBursts(t *testing.T) {
+
+	start := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	entries := []*Entry{
+		{Key: "photos/a", Kind: MediaKindImage, PHash: 0xff00, HasPHash: true, Taken: start, Size: 100},
+		{Key: "photos/b", Kind: MediaKindImage, PHash: 0xff01, HasPHash: true, Taken: start.Add(2 * time.Second), Size: 300},
+		{Key: "photos/c", Kind: MediaKindImage, PHash: 0xff03, HasPHash: true, Taken: start.Add(4 * time.Second), Size: 200},
+		// Same scene, but long after the burst
+		{Key: "photos/d", Kind: MediaKindImage, PHash: 0xff00, HasPHash: true, Taken: start.Add(time.Hour), Size: 100},
+		// Taken during the burst, but a different picture
+		{Key: "photos/e", Kind: MediaKindImage, PHash: 0x00ff, HasPHash: true, Taken: start.Add(time.Second), Size: 100},
+		{Key: "photos/f", Kind: MediaKindVideo, Taken: start},
+		{Key: "photos/g", Kind: MediaKindImage, Taken: start},
+	}
+
+	result := CollapseBursts(entries, 5*time.Second, 4)
+
+	var keys []string
+	for _, e := range result {
+		keys = append(keys, e.Key)
+	}
+	expected := []string{"photos/b", "photos/d", "photos/e", "photos/f", "photos/g"}
+	if len(keys) != len(expected) {
+		t.Fatalf("unexpected entries: got \n%v want \n%v", keys, expected)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Fatalf("unexpected entries: got \n%v want \n%v", keys, expected)
+		}
+	}
+	if n := len(result[0].Burst); n != 2 {
+		t.Errorf("burst cover holds %d other photos, want 2", n)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CatalogChangesPrefix is where the uploader keeps the catalog journal in the photo bucket
+const CatalogChangesPrefix = "catalog/changes/"
+
+// catalogTimeFormat is the time prefix of journal keys, which sorts lexically in time order
+const catalogTimeFormat = "20060102T150405.000000000Z"
+
+// CatalogOverlap is how far before the newest applied change the journal is
+// read again, so changes written slightly out of order aren't missed
+var CatalogOverlap = time.Minute
+
+// CatalogRecord is everything known about a published photo, video or collage,
+// as recorded by the uploader
+type CatalogRecord struct {
+	Key           string    `json:"key"`
+	Kind          string    `json:"kind"`
+	ContentType   string    `json:"content_type"`
+	Size          int64     `json:"size"`
+	Caption       string    `json:"caption"`
+	Aliases       []string  `json:"aliases,omitempty"`
+	Album         string    `json:"album"`
+	Width         int       `json:"width,omitempty"`
+	Height        int       `json:"height,omitempty"`
+	Taken         time.Time `json:"taken"`
+	PHash         string    `json:"phash,omitempty"`
+	Sharpness     float64   `json:"sharpness,omitempty"`
+	Brightness    float64   `json:"brightness,omitempty"`
+	Poster        string    `json:"poster,omitempty"`
+	VoiceCaptions []string  `json:"voice_captions,omitempty"`
+	Collage       string    `json:"collage,omitempty"`
+	Transforms    []string  `json:"transforms,omitempty"`
+	Sender        string    `json:"sender,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	Deleted       bool      `json:"deleted,omitempty"`
+	Updated       time.Time `json:"updated"`
+	// Created is when the catalog first saw the object
+	Created time.Time `json:"created"`
+}
+
+// Journal is the log of catalog changes
+type Journal interface {
+	// List returns the keys of the changes after startAfter, in order
+	List(startAfter string) ([]string, error)
+	// Get returns a change
+	Get(key string) (*CatalogRecord, error)
+}
+
+// Catalog is the updater's copy of the photo catalog. It's kept in a local
+// file and brought up to date by replaying the journal, so a build only
+// reads the changes since the last one.
+type Catalog struct {
+	path string
+
+	mu    sync.Mutex
+	state *catalogState
+}
+
+// catalogState is the content of the catalog file
+type catalogState struct {
+	// Cursor is the newest journal key that has been applied
+	Cursor string `json:"cursor"`
+	// Applied holds the keys of changes within CatalogOverlap of the cursor,
+	// so they aren't applied twice
+	Applied map[string]bool           `json:"applied"`
+	Records map[string]*CatalogRecord `json:"records"`
+	// Listed is when the photo store listing the catalog was seeded from
+	// was started. Photos the journal recorded before then that weren't
+	// listed have been deleted since.
+	Listed time.Time `json:"listed,omitempty"`
+}
+
+// OpenCatalog loads the catalog in a file, or starts an empty one if the file doesn't exist
+func OpenCatalog(path string) (*Catalog, error) {
+	c := &Catalog{
+		path:  path,
+		state: &catalogState{Applied: map[string]bool{}, Records: map[string]*CatalogRecord{}},
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, c.state); err != nil {
+		return nil, err
+	}
+	if c.state.Applied == nil {
+		c.state.Applied = map[string]bool{}
+	}
+	if c.state.Records == nil {
+		c.state.Records = map[string]*CatalogRecord{}
+	}
+	return c, nil
+}
+
+// Empty reports whether the catalog has never been filled
+func (c *Catalog) Empty() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.Cursor == "" && len(c.state.Records) == 0
+}
+
+// Put adds or updates a record. Fields only known at ingest are kept, and
+// changes older than the recorded one only fill in those fields. It reports
+// whether the catalog changed.
+func (c *Catalog) Put(r *CatalogRecord) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.put(r)
+}
+
+// put is Put with c.mu held
+func (c *Catalog) put(r *CatalogRecord) bool {
+	existing := c.state.Records[r.Key]
+	if existing != nil && r.Updated.Before(existing.Updated) {
+		// A stale change only fills in what a rebuild from object metadata can't recover
+		var changed bool
+		if existing.Sender == "" && r.Sender != "" {
+			existing.Sender, existing.Message = r.Sender, r.Message
+			changed = true
+		}
+		if r.Updated.Before(existing.Created) {
+			existing.Created = r.Updated
+			changed = true
+		}
+		return changed
+	}
+	if existing != nil {
+		if r.Sender == "" {
+			r.Sender = existing.Sender
+		}
+		if r.Message == "" {
+			r.Message = existing.Message
+		}
+		r.Created = existing.Created
+	}
+	if r.Created.IsZero() {
+		r.Created = r.Updated
+	}
+	c.state.Records[r.Key] = r
+	return true
+}
+
+// Reset empties the catalog, so the whole journal is replayed on the next sync
+func (c *Catalog) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = &catalogState{Applied: map[string]bool{}, Records: map[string]*CatalogRecord{}}
+}
+
+// Seed adds records for entries from a listing of the photo store started
+// at listed, for photos published before the catalog existed or when it's
+// rebuilt. Replaying the journal afterwards doesn't add back the photos
+// that weren't listed.
+func (c *Catalog) Seed(entries []*Entry, listed time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		c.put(NewCatalogRecord(e))
+	}
+	c.state.Listed = listed
+}
+
+// Sync applies the journal's new changes and saves the catalog.
+// It returns how many changes were applied.
+func (c *Catalog) Sync(j Journal) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys, err := j.List(c.startAfter())
+	if err != nil {
+		return 0, err
+	}
+	var applied int
+	for _, key := range keys {
+		if c.state.Applied[key] {
+			continue
+		}
+		r, err := j.Get(key)
+		if err != nil {
+			return applied, err
+		}
+		// A photo recorded before the listing the catalog was seeded from,
+		// but missing from it, has been deleted since
+		if c.state.Records[r.Key] != nil || r.Updated.After(c.state.Listed) {
+			c.put(r)
+		}
+		c.state.Applied[key] = true
+		if key > c.state.Cursor {
+			c.state.Cursor = key
+		}
+		applied++
+	}
+	// Forget the changes that are too old to be listed again
+	start := c.startAfter()
+	for key := range c.state.Applied {
+		if key <= start {
+			delete(c.state.Applied, key)
+		}
+	}
+	if applied == 0 {
+		return 0, nil
+	}
+	return applied, c.save()
+}
+
+// startAfter returns the journal key to list from: CatalogOverlap before the cursor
+func (c *Catalog) startAfter() string {
+	if c.state.Cursor == "" {
+		return ""
+	}
+	stamp := strings.SplitN(strings.TrimPrefix(c.state.Cursor, CatalogChangesPrefix), "-", 2)[0]
+	t, err := time.Parse(catalogTimeFormat, stamp)
+	if err != nil {
+		return c.state.Cursor
+	}
+	return CatalogChangesPrefix + t.Add(-CatalogOverlap).Format(catalogTimeFormat)
+}
+
+// Save writes the catalog to its file
+func (c *Catalog) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+// save is Save with c.mu held
+func (c *Catalog) save() error {
+	buf, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, buf)
+}
+
+// Records returns the records in the catalog, including deleted ones, ordered by key
+func (c *Catalog) Records() []*CatalogRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]*CatalogRecord, 0, len(c.state.Records))
+	for _, r := range c.state.Records {
+		record := *r
+		result = append(result, &record)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// Entries returns the gallery entries for the photos and videos in the catalog
+func (c *Catalog) Entries() []*Entry {
+	result := []*Entry{}
+	for _, r := range c.Records() {
+		if r.Deleted || r.Kind == MediaKindCollage || !strings.HasPrefix(r.Key, "photos/") {
+			continue
+		}
+		result = append(result, r.Entry())
+	}
+	return result
+}
+
+// Entry returns the gallery entry for a key, or nil if it isn't in the catalog
+func (c *Catalog) Entry(key string) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.state.Records[key]
+	if r == nil || r.Deleted {
+		return nil
+	}
+	return r.Entry()
+}
+
+// Record returns a copy of the record for a key, including a deleted one,
+// or nil if it isn't in the catalog
+func (c *Catalog) Record(key string) *CatalogRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.state.Records[key]
+	if r == nil {
+		return nil
+	}
+	record := *r
+	return &record
+}
+
+// Delete marks the record for a key as deleted
+func (c *Catalog) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.state.Records[key]
+	if r == nil || r.Deleted {
+		return
+	}
+	record := *r
+	record.Deleted = true
+	record.Updated = time.Now().UTC()
+	c.put(&record)
+}
+
+// NewCatalogRecord creates a record from a gallery entry read from object metadata
+func NewCatalogRecord(e *Entry) *CatalogRecord {
+	r := &CatalogRecord{
+		Key:           e.Key,
+		Kind:          e.Kind,
+		ContentType:   e.ContentType,
+		Size:          e.Size,
+		Caption:       e.Caption,
+		Album:         e.Album,
+		Width:         e.Width,
+		Height:        e.Height,
+		Taken:         e.Taken,
+		Sharpness:     e.Sharpness,
+		Poster:        e.Poster,
+		VoiceCaptions: e.VoiceCaptions,
+		Collage:       e.Collage,
+		Updated:       e.Uploaded,
+	}
+	if e.HasPHash {
+		r.PHash = fmt.Sprintf("%016x", e.PHash)
+	}
+	return r
+}
+
+// Entry creates the gallery entry for a record
+func (r *CatalogRecord) Entry() *Entry {
+	e := &Entry{
+		Key:           r.Key,
+		Kind:          r.Kind,
+		ContentType:   r.ContentType,
+		Caption:       r.Caption,
+		Poster:        r.Poster,
+		VoiceCaptions: r.VoiceCaptions,
+		Size:          r.Size,
+		Width:         r.Width,
+		Height:        r.Height,
+		Taken:         r.Taken,
+		Uploaded:      r.Created,
+		Album:         r.Album,
+		Sharpness:     r.Sharpness,
+		Collage:       r.Collage,
+	}
+	if e.Kind == "" {
+		e.Kind = MediaKindImage
+		if strings.HasPrefix(r.ContentType, "video/") {
+			e.Kind = MediaKindVideo
+		}
+	}
+	if e.Taken.IsZero() {
+		e.Taken = r.Created
+	}
+	if e.Album == "" {
+		e.Album = DefaultAlbum
+	}
+	if hash, err := strconv.ParseUint(r.PHash, 16, 64); err == nil {
+		e.PHash, e.HasPHash = hash, true
+	}
+	return e
+}
+
+// loadCatalog brings a catalog up to date with the journal in the photo
+// bucket and the changes of a build, and returns its entries. An empty
+// catalog is first filled from the metadata of the photos in the bucket.
+func loadCatalog(c *Catalog, changes *Changes) ([]*Entry, error) {
+	if c.Empty() {
+		listed := time.Now()
+		objects, err := S3ListPhotoStore(PhotoBucket)
+		if err != nil {
+			return nil, err
+		}
+		entries, _, err := ParseObjects(&s3.ListObjectsV2Output{Contents: objects})
+		if err != nil {
+			return nil, err
+		}
+		c.Seed(entries, listed)
+		log.Printf("Seeded the catalog with %d photos", len(entries))
+		if err := c.Save(); err != nil {
+			return nil, err
+		}
+	}
+	applied, err := c.Sync(&S3Journal{Svc: s3Client(), Bucket: PhotoBucket})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Applied %d catalog changes", applied)
+	if !changes.Full {
+		if err := applyCatalogChanges(c, changes, S3GetMetadata); err != nil {
+			return nil, err
+		}
+	}
+	return c.Entries(), nil
+}
+
+// S3Journal reads the catalog journal from a bucket
+type S3Journal struct {
+	Svc    *s3.S3
+	Bucket string
+}
+
+// List returns the keys of the changes after startAfter, in order
+func (j *S3Journal) List(startAfter string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(j.Bucket),
+		Prefix: aws.String(CatalogChangesPrefix),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	var keys []string
+	err := j.Svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Get returns a change
+func (j *S3Journal) Get(key string) (*CatalogRecord, error) {
+	result, err := j.Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(j.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	r := &CatalogRecord{}
+	if err := json.NewDecoder(result.Body).Decode(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
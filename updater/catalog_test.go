@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// memJournal is a journal held in memory
+type memJournal struct {
+	changes map[string]*CatalogRecord
+	gets    int
+}
+
+func (j *memJournal) add(r *CatalogRecord) string {
+	key := CatalogChangesPrefix + r.Updated.UTC().Format(catalogTimeFormat) + "-" + strings.ReplaceAll(r.Key, "/", "_") + ".json"
+	j.changes[key] = r
+	return key
+}
+
+func (j *memJournal) List(startAfter string) ([]string, error) {
+	var keys []string
+	for key := range j.changes {
+		if key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (j *memJournal) Get(key string) (*CatalogRecord, error) {
+	j.gets++
+	r := *j.changes[key]
+	return &r, nil
+}
+
+func TestCatalogSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "catalog.json")
+
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	j := &memJournal{changes: map[string]*CatalogRecord{}}
+	j.add(&CatalogRecord{Key: "photos/a", Kind: MediaKindImage, Caption: "first", Sender: "+15550001111", PHash: "00000000000000ff", Updated: start})
+	j.add(&CatalogRecord{Key: "photos/b", Kind: MediaKindVideo, Caption: "video", Updated: start.Add(time.Second)})
+	j.add(&CatalogRecord{Key: "collages/c", Kind: MediaKindCollage, Updated: start.Add(2 * time.Second)})
+
+	c, err := OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Empty() {
+		t.Errorf("new catalog isn't empty")
+	}
+	if n, err := c.Sync(j); err != nil || n != 3 {
+		t.Fatalf("Sync() = %d, %v, want 3 changes", n, err)
+	}
+	if entries := c.Entries(); len(entries) != 2 {
+		t.Fatalf("Entries() returned %d entries, want 2", len(entries))
+	}
+	if e := c.Entry("collages/c"); e == nil || e.Kind != MediaKindCollage {
+		t.Errorf("Entry(collages/c) = %+v", e)
+	}
+	if e := c.Entry("photos/a"); e == nil || !e.HasPHash || e.PHash != 0xff || e.Album != DefaultAlbum {
+		t.Errorf("Entry(photos/a) = %+v", e)
+	}
+
+	// Reopening reads only the new changes
+	c, err = OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.gets = 0
+	if n, err := c.Sync(j); err != nil || n != 0 || j.gets != 0 {
+		t.Fatalf("Sync() with no new changes = %d, %v after %d reads", n, err, j.gets)
+	}
+
+	// A later change updates the record but keeps what was only known at ingest,
+	// and a change written out of order within the overlap is still applied
+	j.add(&CatalogRecord{Key: "photos/a", Kind: MediaKindImage, Caption: "first #edited", Updated: start.Add(time.Hour)})
+	j.add(&CatalogRecord{Key: "photos/d", Kind: MediaKindImage, Updated: start.Add(time.Hour - time.Second)})
+	if n, err := c.Sync(j); err != nil || n != 2 || j.gets != 2 {
+		t.Fatalf("Sync() = %d, %v after %d reads, want 2 changes", n, err, j.gets)
+	}
+	j.add(&CatalogRecord{Key: "photos/e", Kind: MediaKindImage, Updated: start.Add(time.Hour - 2*time.Second)})
+	if n, err := c.Sync(j); err != nil || n != 1 {
+		t.Fatalf("Sync() of a late change = %d, %v, want 1", n, err)
+	}
+	records := map[string]*CatalogRecord{}
+	for _, r := range c.Records() {
+		records[r.Key] = r
+	}
+	a := records["photos/a"]
+	if a.Caption != "first #edited" || a.Sender != "+15550001111" || !a.Created.Equal(start) {
+		t.Errorf("photos/a = %+v", a)
+	}
+	if records["photos/e"] == nil {
+		t.Errorf("late change wasn't applied")
+	}
+
+	// Stale changes never replace newer ones
+	if c.Put(&CatalogRecord{Key: "photos/a", Caption: "stale", Updated: start}) {
+		t.Errorf("Put() of a stale change succeeded")
+	}
+	if e := c.Entry("photos/a"); e.Caption != "first #edited" {
+		t.Errorf("caption = %q after a stale change", e.Caption)
+	}
+
+	// Deleted records aren't in the gallery
+	j.add(&CatalogRecord{Key: "photos/b", Deleted: true, Updated: start.Add(2 * time.Hour)})
+	if _, err := c.Sync(j); err != nil {
+		t.Fatal(err)
+	}
+	if e := c.Entry("photos/b"); e != nil {
+		t.Errorf("deleted photos/b is still an entry")
+	}
+}
+
+func TestCatalogSeed(t *testing.T) {
+	c := &Catalog{state: &catalogState{Applied: map[string]bool{}, Records: map[string]*CatalogRecord{}}}
+	taken := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Seed([]*Entry{{Key: "photos/a", Kind: MediaKindImage, Caption: "#Trip", Album: "trip", Taken: taken, Uploaded: taken, PHash: 0xabc, HasPHash: true, Width: 10, Height: 20}}, taken)
+	e := c.Entry("photos/a")
+	if e == nil || e.Album != "trip" || e.PHash != 0xabc || e.Width != 10 || !e.Uploaded.Equal(taken) {
+		t.Errorf("seeded entry = %+v", e)
+	}
+}
+
+func TestCatalogRebuildKeepsJournalFields(t *testing.T) {
+	c := &Catalog{state: &catalogState{Applied: map[string]bool{}, Records: map[string]*CatalogRecord{}}}
+	ingested := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	modified := ingested.Add(time.Hour)
+
+	// A rebuild only knows the object's metadata, then the journal is replayed
+	c.Seed([]*Entry{{Key: "photos/a", Kind: MediaKindImage, Caption: "rotated", Uploaded: modified}}, modified)
+	if !c.Put(&CatalogRecord{Key: "photos/a", Caption: "original", Sender: "+15550001111", Message: "MM1", Updated: ingested}) {
+		t.Errorf("Put() of the ingest record didn't change the catalog")
+	}
+	r := c.Records()[0]
+	if r.Caption != "rotated" || r.Sender != "+15550001111" || r.Message != "MM1" || !r.Created.Equal(ingested) {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestApplyCatalogChangesChecksDeletions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Put(&CatalogRecord{Key: "photos/a", Kind: MediaKindImage, Caption: "again", Updated: uploaded})
+	c.Put(&CatalogRecord{Key: "photos/b", Kind: MediaKindImage, Updated: uploaded})
+
+	// photos/a was deleted and uploaded again, and the deletion arrives last
+	fetch := func(key string) (*s3.HeadObjectOutput, error) {
+		if key == "photos/b" {
+			return nil, awserr.New("NotFound", "not found", nil)
+		}
+		return &s3.HeadObjectOutput{LastModified: aws.Time(uploaded)}, nil
+	}
+	if err := applyCatalogChanges(c, &Changes{Deleted: []string{"photos/a", "photos/b"}}, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if e := c.Entry("photos/a"); e == nil || e.Caption != "again" {
+		t.Errorf("photo that still exists was deleted: %+v", e)
+	}
+	if e := c.Entry("photos/b"); e != nil {
+		t.Errorf("deleted photo is still an entry: %+v", e)
+	}
+}
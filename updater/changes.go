@@ -0,0 +1,255 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// UpdateRequest is the body of an update request. An empty body, or one
+// with Full set, requests a rebuild from the whole photo bucket.
+type UpdateRequest struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
+	// Message is the SID of the message that caused the changes, if any
+	Message string `json:"message"`
+	Full    bool   `json:"full"`
+}
+
+// Changes are the photos a build adds, updates and removes. The changes of
+// coalesced update requests are merged, the latest change to a key winning.
+type Changes struct {
+	Added    []string `json:"added,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"`
+	// Messages are the SIDs of the messages that caused the changes
+	Messages []string `json:"messages,omitempty"`
+	// Full is set when the build reads every photo rather than applying the changes
+	Full bool `json:"full"`
+}
+
+// Change operations
+const (
+	changeAdded    = "added"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+)
+
+// NewChanges returns the changes requested by an update request.
+// Keys outside the photo store are ignored.
+func NewChanges(r *UpdateRequest) *Changes {
+	if r == nil || r.Full {
+		return &Changes{Full: true}
+	}
+	c := &Changes{}
+	ops := map[string]string{}
+	apply(ops, changeAdded, r.Added)
+	apply(ops, changeModified, r.Modified)
+	apply(ops, changeDeleted, r.Deleted)
+	c.set(ops)
+	if r.Message != "" {
+		c.Messages = []string{r.Message}
+	}
+	if len(ops) == 0 && r.Message == "" {
+		// Nothing was described, so nothing can be patched
+		c.Full = true
+	}
+	return c
+}
+
+// Merge adds the changes of a later update to c
+func (c *Changes) Merge(later *Changes) {
+	c.Full = c.Full || later.Full
+	c.Messages = append(c.Messages, later.Messages...)
+	ops := c.ops()
+	apply(ops, changeAdded, later.Added)
+	apply(ops, changeModified, later.Modified)
+	apply(ops, changeDeleted, later.Deleted)
+	c.set(ops)
+}
+
+// Copy returns a copy of c
+func (c *Changes) Copy() *Changes {
+	result := &Changes{Full: c.Full}
+	result.Messages = append(result.Messages, c.Messages...)
+	result.set(c.ops())
+	return result
+}
+
+// Empty reports whether there is nothing to apply
+func (c *Changes) Empty() bool {
+	return !c.Full && len(c.Added)+len(c.Modified)+len(c.Deleted) == 0
+}
+
+// ops returns the operation for each changed key
+func (c *Changes) ops() map[string]string {
+	ops := map[string]string{}
+	apply(ops, changeAdded, c.Added)
+	apply(ops, changeModified, c.Modified)
+	apply(ops, changeDeleted, c.Deleted)
+	return ops
+}
+
+// keys returns the deleted, added and modified keys
+func (c *Changes) keys() []string {
+	return append(append(append([]string{}, c.Deleted...), c.Added...), c.Modified...)
+}
+
+// set replaces the changed keys with ops, in key order
+func (c *Changes) set(ops map[string]string) {
+	c.Added, c.Modified, c.Deleted = nil, nil, nil
+	keys := make([]string, 0, len(ops))
+	for key := range ops {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch ops[key] {
+		case changeAdded:
+			c.Added = append(c.Added, key)
+		case changeModified:
+			c.Modified = append(c.Modified, key)
+		case changeDeleted:
+			c.Deleted = append(c.Deleted, key)
+		}
+	}
+}
+
+// apply records op for keys. A photo that is added and then modified is
+// still new, and one that is deleted and added again is new once more.
+func apply(ops map[string]string, op string, keys []string) {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "photos/") || key == "photos/" {
+			continue
+		}
+		if op == changeModified && ops[key] == changeAdded {
+			continue
+		}
+		ops[key] = op
+	}
+}
+
+// PhotoIndex is the updater's copy of the photos in the bucket, or in the
+// local photo directory, when there's no catalog. It's filled by a full
+// build and patched by the changes of later ones, so they only read the
+// metadata of the changed photos.
+type PhotoIndex struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewPhotoIndex creates an empty index
+func NewPhotoIndex() *PhotoIndex {
+	return &PhotoIndex{}
+}
+
+// photoIndex holds the photos of the last build
+var photoIndex = NewPhotoIndex()
+
+// Ready reports whether the index has been filled by a full build
+func (x *PhotoIndex) Ready() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.entries != nil
+}
+
+// Replace fills the index with the entries of a full build
+func (x *PhotoIndex) Replace(entries []*Entry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = map[string]*Entry{}
+	for _, e := range entries {
+		x.entries[e.Key] = e
+	}
+}
+
+// Apply patches the index with changes, reading the changed photos with
+// entry. Photos that entry returns nil for no longer exist and are removed.
+// Deleted photos are read too, since a late notification of a deletion
+// mustn't remove a photo that was uploaded again.
+func (x *PhotoIndex) Apply(c *Changes, entry func(key string) (*Entry, error)) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, key := range c.keys() {
+		e, err := entry(key)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			delete(x.entries, key)
+			continue
+		}
+		x.entries[key] = e
+	}
+	return nil
+}
+
+// Entries returns copies of the indexed entries, ordered by key
+func (x *PhotoIndex) Entries() []*Entry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	result := make([]*Entry, 0, len(x.entries))
+	for _, e := range x.entries {
+		entry := *e
+		entry.Burst = nil
+		result = append(result, &entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// S3Entry returns the gallery entry for an object in the photo bucket,
+// or nil if it doesn't exist
+func S3Entry(key string) (*Entry, error) {
+	obj, err := S3GetMetadata(key)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewEntry(key, obj), nil
+}
+
+// isNotFound reports whether err means an object doesn't exist
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// applyCatalogChanges patches a catalog with changes the journal may not
+// have recorded, such as photos deleted from the bucket by hand. Changed
+// photos are read from their metadata only when the catalog hasn't recorded
+// them since they last changed, so the richer records written at ingest are
+// kept. Deleted photos are checked too, and only removed when they're gone:
+// S3 doesn't deliver separate event notifications in order, and a deletion
+// hides a photo from every older journal record.
+func applyCatalogChanges(c *Catalog, changes *Changes, fetch func(key string) (*s3.HeadObjectOutput, error)) error {
+	for _, key := range changes.keys() {
+		obj, err := fetch(key)
+		if isNotFound(err) {
+			c.Delete(key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if r := c.Record(key); r != nil && !r.Deleted && !r.Updated.Before(aws.TimeValue(obj.LastModified)) {
+			continue
+		}
+		c.Put(NewCatalogRecord(NewEntry(key, obj)))
+	}
+	return c.Save()
+}
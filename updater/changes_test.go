@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestChangesMerge(t *testing.T) {
+
+	c := NewChanges(&UpdateRequest{
+		Added:    []string{"photos/a", "photos/b", "collages/c"},
+		Modified: []string{"photos/a", "photos/d"},
+		Message:  "MM1",
+	})
+	c.Merge(NewChanges(&UpdateRequest{
+		Added:   []string{"photos/e"},
+		Deleted: []string{"photos/b", "photos/d"},
+		Message: "MM2",
+	}))
+	c.Merge(NewChanges(&UpdateRequest{Added: []string{"photos/d"}}))
+
+	expected := &Changes{
+		Added:    []string{"photos/a", "photos/d", "photos/e"},
+		Deleted:  []string{"photos/b"},
+		Messages: []string{"MM1", "MM2"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("unexpected changes: got %+v want %+v", c, expected)
+	}
+
+	c.Merge(NewChanges(nil))
+	if !c.Full {
+		t.Errorf("merging a full rebuild isn't full: %+v", c)
+	}
+	if c := NewChanges(&UpdateRequest{}); !c.Full {
+		t.Errorf("an empty update isn't a full rebuild: %+v", c)
+	}
+}
+
+func TestPhotoIndexApply(t *testing.T) {
+
+	x := NewPhotoIndex()
+	x.Replace([]*Entry{
+		{Key: "photos/a", Caption: "a"},
+		{Key: "photos/b", Caption: "b"},
+		{Key: "photos/c", Caption: "c"},
+	})
+
+	fetch := func(key string) (*Entry, error) {
+		switch key {
+		case "photos/b", "photos/c":
+			return nil, nil
+		case "photos/x":
+			return nil, errors.New("access denied")
+		}
+		return &Entry{Key: key, Caption: key + " updated"}, nil
+	}
+	changes := &Changes{
+		Added:    []string{"photos/d"},
+		Modified: []string{"photos/a", "photos/c"},
+		Deleted:  []string{"photos/b"},
+	}
+	if err := x.Apply(changes, fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	var captions []string
+	for _, e := range x.Entries() {
+		captions = append(captions, e.Caption)
+	}
+	expected := []string{"photos/a updated", "photos/d updated"}
+	if !reflect.DeepEqual(captions, expected) {
+		t.Errorf("unexpected entries: got %v want %v", captions, expected)
+	}
+
+	// A late deletion of a photo that exists again doesn't remove it
+	if err := x.Apply(&Changes{Deleted: []string{"photos/a"}}, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if entries := x.Entries(); len(entries) != 2 {
+		t.Errorf("photo that exists was removed: %+v", entries)
+	}
+
+	if err := x.Apply(&Changes{Added: []string{"photos/x"}}, fetch); err == nil {
+		t.Errorf("failed fetch wasn't reported")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sort"
+)
+
+// MediaKindCollage is the kind of collages composed from multi-photo messages
+const MediaKindCollage = "collage"
+
+// SortEntries orders entries newest first
+func SortEntries(entries []*Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Taken.After(entries[j].Taken)
+	})
+}
+
+// AddCollageCovers inserts the collage of a multi-photo message before
+// the message's first photo, as the cover of the post. cover returns the
+// entry for a collage key, or nil if the collage can't be found.
+func AddCollageCovers(entries []*Entry, cover func(key string) *Entry) []*Entry {
+	result := []*Entry{}
+	added := map[string]bool{}
+	for _, e := range entries {
+		if e.Collage != "" && !added[e.Collage] {
+			added[e.Collage] = true
+			if c := cover(e.Collage); c != nil {
+				c.Kind = MediaKindCollage
+				result = append(result, c)
+			}
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// ShareImage returns the key of the newest collage, used as the
+// gallery's link preview image, or an empty string if there isn't one
+func ShareImage(entries []*Entry) string {
+	var newest *Entry
+	for _, e := range entries {
+		if e.Kind == MediaKindCollage && (newest == nil || e.Taken.After(newest.Taken)) {
+			newest = e
+		}
+	}
+	if newest == nil {
+		return ""
+	}
+	return newest.Key
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddCollageCovers(t *testing.T) {
+
+	now := time.Now()
+	entries := []*Entry{
+		{Key: "photos/a", Kind: MediaKindImage, Collage: "collages/1", Taken: now},
+		{Key: "photos/b", Kind: MediaKindImage, Collage: "collages/1", Taken: now},
+		{Key: "photos/c", Kind: MediaKindImage, Taken: now.Add(-time.Hour)},
+		{Key: "photos/d", Kind: MediaKindImage, Collage: "collages/missing", Taken: now.Add(-2 * time.Hour)},
+	}
+
+	result := AddCollageCovers(entries, func(key string) *Entry {
+		if key == "collages/missing" {
+			return nil
+		}
+		return &Entry{Key: key, Taken: now}
+	})
+
+	expected := []string{"collages/1", "photos/a", "photos/b", "photos/c", "photos/d"}
+	if len(result) != len(expected) {
+		t.Fatalf("got %d entries, want %d", len(result), len(expected))
+	}
+	for i, e := range result {
+		if e.Key != expected[i] {
+			t.Errorf("entry %d: got %v want %v", i, e.Key, expected[i])
+		}
+	}
+	if result[0].Kind != MediaKindCollage {
+		t.Errorf("cover has kind %q", result[0].Kind)
+	}
+
+	if got := ShareImage(result); got != "collages/1" {
+		t.Errorf("unexpected share image: got %v want %v", got, "collages/1")
+	}
+	if got := ShareImage(entries); got != "" {
+		t.Errorf("share image without collages: got %v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PhotosDataVersion is the version of the data/photos.json format. It's
+// bumped whenever a field is removed or changes meaning; new fields can be
+// added without bumping it.
+const PhotosDataVersion = 1
+
+// FilesURL is where the photo bucket's objects are served from
+var FilesURL = "https://files.czan.io/"
+
+// DefaultAlbum is the album of photos without an album hashtag
+const DefaultAlbum = "default"
+
+// PhotosData is the gallery catalog written to data/photos.json. The home
+// page layout renders the gallery from it, and other tools can read it.
+type PhotosData struct {
+	Version   int       `json:"version"`
+	Generated time.Time `json:"generated"`
+	// ShareImage is the URL of the link preview image
+	ShareImage string       `json:"share_image,omitempty"`
+	Photos     []*PhotoData `json:"photos"`
+}
+
+// PhotoData is a photo or video in the gallery catalog
+type PhotoData struct {
+	Key         string `json:"key"`
+	Kind        string `json:"kind"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	// PosterURL is the still shown before a video plays
+	PosterURL string `json:"poster_url,omitempty"`
+	// Caption is untrusted text sent with the photo
+	Caption  string    `json:"caption"`
+	Width    int       `json:"width,omitempty"`
+	Height   int       `json:"height,omitempty"`
+	Taken    time.Time `json:"taken"`
+	Uploaded time.Time `json:"uploaded"`
+	Album    string    `json:"album"`
+	// Tags are the caption's hashtags, without the leading #
+	Tags          []string `json:"tags"`
+	VoiceCaptions []string `json:"voice_captions,omitempty"`
+	// Burst lists the keys of the near-identical shots this photo stands for
+	Burst []string `json:"burst,omitempty"`
+	// Collage is the key of the collage composed from this photo's message
+	Collage string `json:"collage,omitempty"`
+}
+
+// NewPhotosData creates the gallery catalog for the entries, in order
+func NewPhotosData(entries []*Entry, shareImage string, generated time.Time) *PhotosData {
+	data := &PhotosData{
+		Version:    PhotosDataVersion,
+		Generated:  generated.UTC(),
+		ShareImage: shareImage,
+		Photos:     []*PhotoData{},
+	}
+	for _, e := range entries {
+		p := &PhotoData{
+			Key:         e.Key,
+			Kind:        e.Kind,
+			URL:         fileURL(e.Key),
+			ContentType: mediaType(e.ContentType),
+			Caption:     CleanCaption(e.Caption),
+			Width:       e.Width,
+			Height:      e.Height,
+			Taken:       e.Taken.UTC(),
+			Uploaded:    e.Uploaded.UTC(),
+			Album:       e.Album,
+			Tags:        HashTags(e.Caption),
+			Collage:     e.Collage,
+		}
+		if e.Poster != "" {
+			p.PosterURL = fileURL(e.Poster)
+		}
+		for _, key := range e.VoiceCaptions {
+			p.VoiceCaptions = append(p.VoiceCaptions, fileURL(key))
+		}
+		for _, b := range e.Burst {
+			p.Burst = append(p.Burst, b.Key)
+		}
+		data.Photos = append(data.Photos, p)
+	}
+	return data
+}
+
+// WritePhotosData writes the gallery catalog to data/photos.json in the site in dir
+func WritePhotosData(dir string, data *PhotosData) error {
+	buf, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, "data", "photos.json")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, buf, 0644); err != nil {
+		return fmt.Errorf("failed creating file: %s", err)
+	}
+	return nil
+}
+
+// CleanCaption normalizes an untrusted caption. Control characters,
+// including line breaks, become spaces and runs of spaces are collapsed.
+func CleanCaption(caption string) string {
+	caption = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return ' '
+		}
+		return r
+	}, caption)
+	return strings.Join(strings.Fields(caption), " ")
+}
+
+// HashTags returns the hashtags in a caption, lowercased and without the #
+func HashTags(caption string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, word := range strings.Fields(CleanCaption(caption)) {
+		if !strings.HasPrefix(word, "#") {
+			continue
+		}
+		tag := strings.ToLower(strings.Trim(word, "#.,!?"))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// fileURL returns the public URL of an object in the photo bucket
+func fileURL(key string) string {
+	return FilesURL + (&url.URL{Path: key}).EscapedPath()
+}
+
+// mediaType returns the media type of a Content-Type, or an empty string if it isn't valid
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return t
+}
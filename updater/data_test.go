@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// hostileCaptions are captions that would break out of a naively generated manifest
+var hostileCaptions = []string{
+	`say "cheese"`,
+	`done >}}{{< figure link="https://evil.example/x.jpg" >}}`,
+	`<script>alert(1)</script>`,
+	`trailing backslash \`,
+	"line\nbreak\r\nand\ttab",
+	"nul\x00byte and bell\a",
+	`{{ .Site.Params }} {{% include %}}`,
+	"emoji 🎉 and accents é #Party",
+}
+
+func TestNewPhotosData(t *testing.T) {
+	taken := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []*Entry{
+		{Key: "photos/a", Kind: MediaKindImage, ContentType: "image/jpeg", Caption: "Beach day #Summer #beach, #summer", Width: 4032, Height: 3024, Taken: taken, Album: "summer",
+			VoiceCaptions: []string{"audio/v"}, Burst: []*Entry{{Key: "photos/b"}, {Key: "photos/c"}}},
+		{Key: "videos/IMG 1.mov", Kind: MediaKindVideo, ContentType: "video/quicktime; codecs=x", Poster: "photos/p", Album: DefaultAlbum},
+	}
+	data := NewPhotosData(entries, "https://files.czan.io/collages/x", taken)
+
+	if data.Version != PhotosDataVersion || data.ShareImage != "https://files.czan.io/collages/x" || len(data.Photos) != 2 {
+		t.Fatalf("NewPhotosData() = %+v", data)
+	}
+	photo := data.Photos[0]
+	if photo.URL != "https://files.czan.io/photos/a" || photo.Width != 4032 || photo.Height != 3024 || !photo.Taken.Equal(taken) {
+		t.Errorf("photo = %+v", photo)
+	}
+	if want := []string{"summer", "beach"}; !reflect.DeepEqual(photo.Tags, want) {
+		t.Errorf("Tags = %v, want %v", photo.Tags, want)
+	}
+	if want := []string{"photos/b", "photos/c"}; !reflect.DeepEqual(photo.Burst, want) {
+		t.Errorf("Burst = %v, want %v", photo.Burst, want)
+	}
+	if want := []string{"https://files.czan.io/audio/v"}; !reflect.DeepEqual(photo.VoiceCaptions, want) {
+		t.Errorf("VoiceCaptions = %v, want %v", photo.VoiceCaptions, want)
+	}
+	video := data.Photos[1]
+	if video.URL != "https://files.czan.io/videos/IMG%201.mov" || video.PosterURL != "https://files.czan.io/photos/p" || video.ContentType != "video/quicktime" {
+		t.Errorf("video = %+v", video)
+	}
+}
+
+func TestWritePhotosDataHostileCaptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "site-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var entries []*Entry
+	for i, caption := range hostileCaptions {
+		entries = append(entries, &Entry{Key: "photos/" + string(rune('a'+i)), Kind: MediaKindImage, Caption: caption})
+	}
+	if err := WritePhotosData(dir, NewPhotosData(entries, "", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "data", "photos.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &PhotosData{}
+	if err := json.Unmarshal(buf, data); err != nil {
+		t.Fatalf("data/photos.json isn't valid JSON: %s", err)
+	}
+	if len(data.Photos) != len(hostileCaptions) {
+		t.Fatalf("got %d photos, want %d", len(data.Photos), len(hostileCaptions))
+	}
+	for i, caption := range hostileCaptions {
+		if got, want := data.Photos[i].Caption, CleanCaption(caption); got != want {
+			t.Errorf("caption %q round trips to %q, want %q", caption, got, want)
+		}
+	}
+}
+
+func TestCleanCaption(t *testing.T) {
+	tests := []struct {
+		caption string
+		want    string
+	}{
+		{"", ""},
+		{"  hello   world ", "hello world"},
+		{"line\nbreak", "line break"},
+		{"tab\tand\x00nul", "tab and nul"},
+		{"bad � rune", "bad rune"},
+		{"#album caption", "#album caption"},
+	}
+	for _, tt := range tests {
+		if got := CleanCaption(tt.caption); got != tt.want {
+			t.Errorf("CleanCaption(%q) = %q, want %q", tt.caption, got, tt.want)
+		}
+	}
+}
+
+func TestNewEntryAlbum(t *testing.T) {
+	obj := &s3.HeadObjectOutput{Metadata: map[string]*string{"Caption": aws.String("#Hiking up the hill")}}
+	if e := NewEntry("photos/a", obj); e.Album != DefaultAlbum {
+		t.Errorf("album without metadata = %q", e.Album)
+	}
+	obj.Metadata["Album"] = aws.String("hiking")
+	if e := NewEntry("photos/a", obj); e.Album != "hiking" {
+		t.Errorf("album = %q, want hiking", e.Album)
+	}
+}
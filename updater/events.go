@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// S3Event is an S3 event notification
+type S3Event struct {
+	Records []S3EventRecord `json:"Records"`
+}
+
+// S3EventRecord is a change to one object
+type S3EventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			// Key is URL encoded
+			Key string `json:"key"`
+			// Sequencer orders the events for a key
+			Sequencer string `json:"sequencer"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// snsMessage is an S3 event notification delivered by SNS
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// EventChanges returns the photo changes described by an S3 event
+// notification, which may be wrapped in an SNS message. Events for objects
+// in other buckets are ignored.
+func EventChanges(body []byte, bucket string) (*Changes, error) {
+	sns := &snsMessage{}
+	if err := json.Unmarshal(body, sns); err == nil && sns.Type == "Notification" {
+		body = []byte(sns.Message)
+	}
+	event := &S3Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, fmt.Errorf("invalid event: %s", err)
+	}
+
+	// S3 doesn't deliver events in order, so a key's events are applied in
+	// the order of their sequencers. Separate notifications can still arrive
+	// out of order, so builds check that deleted photos are really gone.
+	records := event.Records
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i].S3.Object, records[j].S3.Object
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return sequencerLess(a.Sequencer, b.Sequencer)
+	})
+	ops := map[string]string{}
+	for _, r := range records {
+		if bucket != "" && r.S3.Bucket.Name != bucket {
+			continue
+		}
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			log.Printf("Ignoring event for %q: %s", r.S3.Object.Key, err)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(r.EventName, "ObjectCreated:"):
+			apply(ops, changeAdded, []string{key})
+		case strings.HasPrefix(r.EventName, "ObjectRemoved:"):
+			apply(ops, changeDeleted, []string{key})
+		}
+	}
+	changes := &Changes{}
+	changes.set(ops)
+	return changes, nil
+}
+
+// sequencerLess reports whether sequencer a is before b. Sequencers are
+// hex strings that S3 says to compare after right-padding the shorter one
+// with zeros.
+func sequencerLess(a, b string) bool {
+	for len(a) < len(b) {
+		a += "0"
+	}
+	for len(b) < len(a) {
+		b += "0"
+	}
+	return a < b
+}
+
+// EventsToken authenticates S3 event notifications delivered over HTTP,
+// passed as the token query parameter of the subscription's URL.
+// Notifications aren't accepted over HTTP when it's empty.
+var EventsToken string
+
+// EventsHandler queues a build for the changes in an S3 event notification,
+// delivered directly or by an SNS subscription
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if EventsToken == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(EventsToken)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUpdateSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sns := &snsMessage{}
+	if err := json.Unmarshal(body, sns); err == nil && sns.Type == "SubscriptionConfirmation" {
+		if err := confirmSubscription(sns.SubscribeURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	changes, err := EventChanges(body, PhotoBucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changes.Empty() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, &updateResponse{ID: builder.Trigger("s3-events", changes)})
+}
+
+// confirmSubscription confirms an SNS subscription. Only SNS URLs are
+// visited, so the handler can't be used to make arbitrary requests.
+func confirmSubscription(subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Hostname(), "sns.") || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("invalid subscription URL %q", subscribeURL)
+	}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscription confirmation failed: %s", resp.Status)
+	}
+	log.Printf("Confirmed SNS subscription")
+	return nil
+}
+
+// QueueMessage is a message received from an EventQueue
+type QueueMessage struct {
+	// ID identifies the message to the queue, to delete it
+	ID   string
+	Body []byte
+}
+
+// EventQueue is a queue of S3 event notifications
+type EventQueue interface {
+	// Receive returns the waiting messages
+	Receive() ([]*QueueMessage, error)
+	// Delete removes a handled message
+	Delete(m *QueueMessage) error
+}
+
+// SQSQueue receives S3 event notifications from an SQS queue
+type SQSQueue struct {
+	Svc *sqs.SQS
+	URL string
+}
+
+// Receive returns the waiting messages, waiting up to 20 seconds for one to arrive
+func (q *SQSQueue) Receive() ([]*QueueMessage, error) {
+	result, err := q.Svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.URL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var messages []*QueueMessage
+	for _, m := range result.Messages {
+		messages = append(messages, &QueueMessage{ID: aws.StringValue(m.ReceiptHandle), Body: []byte(aws.StringValue(m.Body))})
+	}
+	return messages, nil
+}
+
+// Delete removes a handled message
+func (q *SQSQueue) Delete(m *QueueMessage) error {
+	_, err := q.Svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.URL),
+		ReceiptHandle: aws.String(m.ID),
+	})
+	return err
+}
+
+// FileQueue is a local stand-in for a queue: each .json file in Dir is a
+// message, received in name order. Writers should create a message under
+// another name and rename it, so partly written files aren't received.
+type FileQueue struct {
+	Dir string
+}
+
+// Receive returns the waiting messages
+func (q *FileQueue) Receive() ([]*QueueMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var messages []*QueueMessage
+	for _, path := range paths {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, &QueueMessage{ID: path, Body: body})
+	}
+	return messages, nil
+}
+
+// Delete removes a handled message
+func (q *FileQueue) Delete(m *QueueMessage) error {
+	err := os.Remove(m.ID)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// PollEvents triggers builds for the S3 event notifications in a queue until
+// ctx is done, waiting interval between polls that find nothing. Messages
+// that can't be parsed are logged and deleted, so they aren't received forever.
+func PollEvents(ctx context.Context, q EventQueue, interval time.Duration, trigger func(source string, changes *Changes) string) {
+	for ctx.Err() == nil {
+		messages, err := q.Receive()
+		if err != nil {
+			log.Printf("Unable to receive events: %s", err)
+		}
+		var deleted int
+		for _, m := range messages {
+			changes, err := EventChanges(m.Body, PhotoBucket)
+			if err != nil {
+				log.Printf("Dropping event %s: %s", m.ID, err)
+			} else if !changes.Empty() {
+				id := trigger("s3-events", changes)
+				log.Printf("Queued build %s for event %s", id, m.ID)
+			}
+			if err := q.Delete(m); err != nil {
+				log.Printf("Unable to delete event %s: %s", m.ID, err)
+				continue
+			}
+			deleted++
+		}
+		// Poll again straight away while the queue is draining
+		if len(messages) > 0 && deleted == len(messages) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEvent = `{"Records": [
+	{"eventName": "ObjectRemoved:Delete", "s3": {"bucket": {"name": "photos"}, "object": {"key": "photos/b", "sequencer": "005F7A3C2B1E"}}},
+	{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "photos"}, "object": {"key": "photos/a+b%2Bc", "sequencer": "005F7A3C2B1D"}}},
+	{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "photos"}, "object": {"key": "photos/b", "sequencer": "005F7A3C2B1D00"}}},
+	{"eventName": "ObjectCreated:Copy", "s3": {"bucket": {"name": "photos"}, "object": {"key": "catalog/changes/x", "sequencer": "005F7A3C2B1F"}}},
+	{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "other"}, "object": {"key": "photos/c", "sequencer": "005F7A3C2B20"}}}
+]}`
+
+func TestEventChanges(t *testing.T) {
+
+	message, _ := json.Marshal(testEvent)
+	sns := `{"Type": "Notification", "Message": ` + string(message) + `}`
+	expected := &Changes{
+		Added:   []string{"photos/a b+c"},
+		Deleted: []string{"photos/b"},
+	}
+	for _, body := range []string{testEvent, sns} {
+		changes, err := EventChanges([]byte(body), "photos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("unexpected changes: got %+v want %+v", changes, expected)
+		}
+	}
+
+	if changes, err := EventChanges([]byte(`{"Event": "s3:TestEvent"}`), "photos"); err != nil || !changes.Empty() {
+		t.Errorf("test event has changes %+v, %v", changes, err)
+	}
+	if _, err := EventChanges([]byte(`<xml/>`), "photos"); err == nil {
+		t.Errorf("invalid event was accepted")
+	}
+}
+
+func TestPollEventsFileQueue(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	PhotoBucket = "photos"
+	files := map[string]string{
+		"1.json":     testEvent,
+		"2.json":     `not json`,
+		"3.json.tmp": testEvent,
+	}
+	for name, body := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var triggered []*Changes
+	trigger := func(source string, changes *Changes) string {
+		triggered = append(triggered, changes)
+		cancel()
+		return "build"
+	}
+	done := make(chan struct{})
+	go func() {
+		PollEvents(ctx, &FileQueue{Dir: dir}, 10*time.Millisecond, trigger)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("polling didn't stop")
+	}
+
+	if len(triggered) != 1 || len(triggered[0].Added) != 1 {
+		t.Errorf("unexpected builds: %+v", triggered)
+	}
+	remaining, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(remaining) != 1 || !strings.HasSuffix(remaining[0], ".tmp") {
+		t.Errorf("unexpected files left in the queue: %v", remaining)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+
+	builder = NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		return &BuildResult{}, nil
+	}, 0)
+	PhotoBucket = "photos"
+	EventsToken = "token"
+	defer func() { EventsToken = "" }()
+
+	tests := []struct {
+		url    string
+		body   string
+		status int
+	}{
+		{"/events?token=token", testEvent, http.StatusAccepted},
+		{"/events?token=guess", testEvent, http.StatusUnauthorized},
+		{"/events?token=token", `{"Event": "s3:TestEvent"}`, http.StatusNoContent},
+		{"/events?token=token", `{"Type": "SubscriptionConfirmation", "SubscribeURL": "http://169.254.169.254/"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", test.url, strings.NewReader(test.body))
+		rr := httptest.NewRecorder()
+		EventsHandler(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s %.30q: got status %d want %d", test.url, test.body, rr.Code, test.status)
+		}
+	}
+
+	// Without a token, notifications aren't accepted at all
+	EventsToken = ""
+	req, _ := http.NewRequest("POST", "/events?token=", strings.NewReader(testEvent))
+	rr := httptest.NewRecorder()
+	EventsHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("notification without a token: got status %d", rr.Code)
+	}
+}
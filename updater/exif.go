@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Exif is the part of a JPEG's Exif metadata the gallery uses
+type Exif struct {
+	// Description is the image description, which cameras and photo
+	// editors use for the caption
+	Description string
+	// Taken is when the photo was taken, in the camera's local time
+	Taken time.Time
+}
+
+// Exif tags
+const (
+	exifTagDescription = 0x010e
+	exifTagExifIFD     = 0x8769
+	exifTagTaken       = 0x9003
+)
+
+// exifTimeFormat is the format of Exif dates
+const exifTimeFormat = "2006:01:02 15:04:05"
+
+// ReadExif reads the Exif metadata of a JPEG. Only the start of the file,
+// where the metadata is, needs to be passed.
+func ReadExif(jpeg []byte) (*Exif, error) {
+	tiff, err := exifSegment(jpeg)
+	if err != nil {
+		return nil, err
+	}
+	if len(tiff) < 8 {
+		return nil, errors.New("short Exif header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid Exif byte order")
+	}
+
+	result := &Exif{}
+	ifd0 := exifIFD(tiff, order, order.Uint32(tiff[4:]))
+	if v, ok := ifd0[exifTagDescription]; ok {
+		result.Description = exifString(tiff, order, v)
+	}
+	if v, ok := ifd0[exifTagExifIFD]; ok {
+		sub := exifIFD(tiff, order, order.Uint32(v[8:]))
+		if v, ok := sub[exifTagTaken]; ok {
+			result.Taken, _ = time.Parse(exifTimeFormat, exifString(tiff, order, v))
+		}
+	}
+	return result, nil
+}
+
+// exifSegment returns the TIFF data of a JPEG's Exif segment
+func exifSegment(jpeg []byte) ([]byte, error) {
+	if len(jpeg) < 2 || jpeg[0] != 0xff || jpeg[1] != 0xd8 {
+		return nil, errors.New("not a JPEG")
+	}
+	for i := 2; i+4 <= len(jpeg); {
+		if jpeg[i] != 0xff {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := jpeg[i+1]
+		// The image data starts at SOS, and there's no Exif after it
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(jpeg[i+2:]))
+		if length < 2 || i+2+length > len(jpeg) {
+			break
+		}
+		segment := jpeg[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		i += 2 + length
+	}
+	return nil, errors.New("no Exif metadata")
+}
+
+// exifIFD returns the 12 byte entries of the IFD at offset, by tag
+func exifIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := map[uint16][]byte{}
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entries[order.Uint16(tiff[start:])] = tiff[start : start+12]
+	}
+	return entries
+}
+
+// exifString returns the value of an ASCII entry
+func exifString(tiff []byte, order binary.ByteOrder, entry []byte) string {
+	const typeASCII = 2
+	if order.Uint16(entry[2:]) != typeASCII {
+		return ""
+	}
+	n := order.Uint32(entry[4:])
+	value := entry[8:12]
+	if n > 4 {
+		offset := order.Uint32(entry[8:])
+		if uint64(offset)+uint64(n) > uint64(len(tiff)) {
+			return ""
+		}
+		value = tiff[offset : offset+n]
+	} else {
+		value = value[:n]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+// testJPEG encodes a small JPEG with an Exif description and date taken
+func testJPEG(t *testing.T, width, height int, description, taken string) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A little-endian TIFF with IFD0 at 8, the Exif IFD after it and the strings at the end
+	description += "\x00"
+	taken += "\x00"
+	const ifd0, exifIFD = 8, 8 + 2 + 2*12 + 4
+	descriptionAt := exifIFD + 2 + 12 + 4
+	takenAt := descriptionAt + len(description)
+	tiff := make([]byte, takenAt+len(taken))
+	order := binary.LittleEndian
+	copy(tiff, "II")
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], ifd0)
+	entry := func(at int, tag, kind uint16, count, value uint32) {
+		order.PutUint16(tiff[at:], tag)
+		order.PutUint16(tiff[at+2:], kind)
+		order.PutUint32(tiff[at+4:], count)
+		order.PutUint32(tiff[at+8:], value)
+	}
+	order.PutUint16(tiff[ifd0:], 2)
+	entry(ifd0+2, exifTagDescription, 2, uint32(len(description)), uint32(descriptionAt))
+	entry(ifd0+14, exifTagExifIFD, 4, 1, exifIFD)
+	order.PutUint16(tiff[exifIFD:], 1)
+	entry(exifIFD+2, exifTagTaken, 2, uint32(len(taken)), uint32(takenAt))
+	copy(tiff[descriptionAt:], description)
+	copy(tiff[takenAt:], taken)
+	// Values of up to 4 bytes are stored in the entry instead of at an offset
+	if len(description) <= 4 {
+		copy(tiff[ifd0+2+8:ifd0+2+12], description+"\x00\x00\x00")
+	}
+	if len(taken) <= 4 {
+		copy(tiff[exifIFD+2+8:exifIFD+2+12], taken+"\x00\x00\x00")
+	}
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	var result bytes.Buffer
+	result.Write(img.Bytes()[:2])
+	result.Write([]byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)})
+	result.Write(segment)
+	result.Write(img.Bytes()[2:])
+	return result.Bytes()
+}
+
+func TestReadExif(t *testing.T) {
+
+	exif, err := ReadExif(testJPEG(t, 4, 3, "Sunset #Beach", "2020:07:04 19:30:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exif.Description != "Sunset #Beach" {
+		t.Errorf("unexpected description %q", exif.Description)
+	}
+	if expected := time.Date(2020, 7, 4, 19, 30, 0, 0, time.UTC); !exif.Taken.Equal(expected) {
+		t.Errorf("unexpected date taken %s, want %s", exif.Taken, expected)
+	}
+
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 2, 2)), nil)
+	for _, data := range [][]byte{plain.Bytes(), []byte("GIF89a"), nil} {
+		if _, err := ReadExif(data); err == nil {
+			t.Errorf("found Exif metadata in %.8q", data)
+		}
+	}
+}
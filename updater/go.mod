@@ -4,6 +4,9 @@ go 1.15
 
 require (
 	github.com/aws/aws-sdk-go v1.34.27
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gorilla/mux v1.8.0
+	github.com/rs/xid v1.4.0
 	github.com/sgryczan/scanley v0.0.0-20200803140325-62029f50e678
+	golang.org/x/sys v0.10.0 // indirect
 )
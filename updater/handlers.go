@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// maxUpdateSize is the largest update request body accepted
+const maxUpdateSize = 1 << 20
+
+type updateResponse struct {
+	ID string `json:"id"`
+}
+
+// UpdateHandler queues a gallery build and returns its ID. The body may be
+// an UpdateRequest describing the changed photos, which the build applies
+// without rereading the others; an empty body or ?full=true rebuilds
+// everything. With ?wait=true it blocks until the build completes and
+// returns its record.
+func UpdateHandler(w http.ResponseWriter, r *http.Request) {
+
+	source := r.Header.Get("X-Trigger-Source")
+	if source == "" {
+		source = r.RemoteAddr
+	}
+	var update *UpdateRequest
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxUpdateSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		update = &UpdateRequest{}
+		if err := json.Unmarshal(body, update); err != nil {
+			http.Error(w, fmt.Sprintf("invalid update: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if full, _ := strconv.ParseBool(r.URL.Query().Get("full")); full {
+		update = nil
+	}
+	id := builder.Trigger(source, NewChanges(update))
+
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait {
+		build, _ := builder.Wait(id)
+		status := http.StatusOK
+		if build.Status == BuildFailed {
+			status = http.StatusInternalServerError
+		}
+		writeJSON(w, status, build)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, &updateResponse{ID: id})
+}
+
+// BuildsHandler lists the recent builds, newest first
+func BuildsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, builder.List())
+}
+
+// BuildHandler returns a single build
+func BuildHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	build, ok := builder.Get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("build %s not found", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, build)
+}
+
+// rollbackResponse reports the release made live and the one it replaced
+type rollbackResponse struct {
+	Release  string `json:"release"`
+	Previous string `json:"previous"`
+}
+
+// releaseMu serializes changes to the live production release
+var releaseMu sync.Mutex
+
+// RollbackHandler makes the release of an earlier build live again
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	release := mux.Vars(r)["build"]
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+
+	ok, err := production.HasRelease(release)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("release %s not found", release), http.StatusNotFound)
+		return
+	}
+	previous, err := production.Current()
+	if err == nil {
+		err = production.Activate(release)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, &rollbackResponse{Release: release, Previous: previous})
+}
+
+// promoteResponse reports the release promoted to production
+type promoteResponse struct {
+	Release  string      `json:"release"`
+	Previous string      `json:"previous"`
+	URL      string      `json:"url"`
+	Sync     *SyncReport `json:"sync"`
+}
+
+// PromoteHandler copies the preview release of a build to production and makes it live
+func PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	release := mux.Vars(r)["build"]
+	if preview == nil {
+		http.Error(w, "previews aren't enabled", http.StatusNotFound)
+		return
+	}
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+
+	ok, err := preview.HasRelease(release)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("preview release %s not found", release), http.StatusNotFound)
+		return
+	}
+	previous, err := production.Current()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report, err := Promote(preview, production, release)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, &promoteResponse{
+		Release:  release,
+		Previous: previous,
+		URL:      production.RootURL(),
+		Sync:     report,
+	})
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	res, _ := json.MarshalIndent(v, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", res)
+}
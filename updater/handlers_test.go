@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBuildHandlers(t *testing.T) {
+
+	builder = NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		return &BuildResult{Photos: 2}, nil
+	}, 0)
+	r := mux.NewRouter()
+	r.HandleFunc("/update", UpdateHandler)
+	r.HandleFunc("/builds", BuildsHandler)
+	r.HandleFunc("/builds/{id}", BuildHandler)
+
+	req, err := http.NewRequest("POST", "/update?wait=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Trigger-Source", "test")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	build := &Build{}
+	if err := json.Unmarshal(rr.Body.Bytes(), build); err != nil {
+		t.Fatal(err)
+	}
+	if build.Status != BuildSucceeded || build.Photos != 2 || build.Triggers[0] != "test" {
+		t.Errorf("unexpected build record: %+v", build)
+	}
+
+	req, _ = http.NewRequest("GET", "/builds/"+build.ID, nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	req, _ = http.NewRequest("GET", "/builds/unknown", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	req, _ = http.NewRequest("GET", "/builds", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	var builds []Build
+	if err := json.Unmarshal(rr.Body.Bytes(), &builds); err != nil || len(builds) != 1 {
+		t.Errorf("unexpected build list: %s", rr.Body.String())
+	}
+}
+
+func TestUpdateHandlerChanges(t *testing.T) {
+
+	builder = NewBuilder(func(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+		return &BuildResult{}, nil
+	}, 0)
+
+	tests := []struct {
+		url    string
+		body   string
+		status int
+		full   bool
+	}{
+		{"/update?wait=true", `{"added": ["photos/a"], "deleted": ["photos/b"], "message": "MM1"}`, http.StatusOK, false},
+		{"/update?wait=true", ``, http.StatusOK, true},
+		{"/update?wait=true", `{"full": true}`, http.StatusOK, true},
+		{"/update?wait=true&full=true", `{"added": ["photos/a"]}`, http.StatusOK, true},
+		{"/update?wait=true", `{"added": "photos/a"}`, http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		UpdateHandler(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s %q: got status %d want %d", test.url, test.body, rr.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		build := &Build{}
+		if err := json.Unmarshal(rr.Body.Bytes(), build); err != nil {
+			t.Fatal(err)
+		}
+		if build.Changes == nil || build.Changes.Full != test.full {
+			t.Errorf("%s %q: unexpected changes %+v", test.url, test.body, build.Changes)
+		}
+	}
+}
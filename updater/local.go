@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LocalSite is a directory the gallery is published to, for previewing
+// builds with a local web server
+type LocalSite struct {
+	Dir string
+	// URL is the URL Dir is served at
+	URL string
+	// Keep is how many releases are kept, including the live one
+	Keep int
+	// Preserve lists the paths under Dir that aren't part of the site, such
+	// as the photos served next to it
+	Preserve []string
+	// copyFile copies a release's file to the root. It's copyFileAtomic
+	// when nil.
+	copyFile func(src, dst string) error
+}
+
+// path returns the path of a file of the site
+func (s *LocalSite) path(file string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(file))
+}
+
+// RootURL returns the URL the live release is served at
+func (s *LocalSite) RootURL() string {
+	return strings.TrimSuffix(s.URL, "/") + "/"
+}
+
+// Publish copies the generated site in dir into a new release
+func (s *LocalSite) Publish(dir, release string) (*SyncReport, error) {
+	local, err := HashTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[string]string{}
+	current, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	if current != "" {
+		if previous, err = HashTree(s.path(ReleaseKey(current, ""))); err != nil {
+			return nil, err
+		}
+	}
+
+	target := s.path(ReleaseKey(release, ""))
+	if err := os.RemoveAll(target); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	if err := copyTree(dir, target, nil); err != nil {
+		return nil, err
+	}
+	plan := PlanSync(local, previous)
+	report := &SyncReport{Uploaded: plan.Upload, Deleted: plan.Delete, Unchanged: plan.Unchanged}
+	log.Printf("Published release %s to %s: %d changed, %d deleted, %d unchanged", release, s.Dir, len(report.Uploaded), len(report.Deleted), report.Unchanged)
+	return report, nil
+}
+
+// Export copies the files of a release to dir
+func (s *LocalSite) Export(release, dir string) error {
+	ok, err := s.HasRelease(release)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("release %s not found", release)
+	}
+	return copyTree(s.path(ReleaseKey(release, "")), dir, nil)
+}
+
+// Current returns the live release, or an empty string if nothing has been published
+func (s *LocalSite) Current() (string, error) {
+	buf, err := ioutil.ReadFile(s.path(pointerKey))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	p := &pointer{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return "", err
+	}
+	return p.Release, nil
+}
+
+// Activate makes a release live by copying its files to the root of the
+// directory and removing the files it doesn't have, then flipping the
+// site's pointer to it. Only the files that differ from the live release
+// are copied, and each is replaced atomically. If that fails partway, the
+// live release is copied back.
+func (s *LocalSite) Activate(release string) error {
+	ok, err := s.HasRelease(release)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("release %s not found", release)
+	}
+	previous, err := s.Current()
+	if err != nil {
+		return err
+	}
+	plan, err := activate(release, previous, s.syncRoot)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(&pointer{Release: release, Activated: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(pointerKey), buf); err != nil {
+		return err
+	}
+	log.Printf("Release %s is live in %s: %d files copied, %d deleted, %d unchanged", release, s.Dir, len(plan.Upload), len(plan.Delete), plan.Unchanged)
+	return nil
+}
+
+// syncRoot copies the files of a release that differ from the root of the
+// directory to it, pages last, and then removes the files the release
+// doesn't have
+func (s *LocalSite) syncRoot(release string) (*SyncPlan, error) {
+	copyFile := s.copyFile
+	if copyFile == nil {
+		copyFile = copyFileAtomic
+	}
+	files, err := HashTree(s.path(ReleaseKey(release, "")))
+	if err != nil {
+		return nil, err
+	}
+	live, err := hashTree(s.Dir, func(rel string) bool {
+		// Hidden files are the temporary files of atomic writes
+		return isLiveFile(rel+"/", s.Preserve) && isLiveFile(rel, s.Preserve) && !strings.HasPrefix(filepath.Base(rel), ".")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plan := PlanSync(files, live)
+	for _, file := range pagesLast(plan.Upload) {
+		if err := copyFile(s.path(ReleaseKey(release, file)), s.path(file)); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range plan.Delete {
+		if err := os.Remove(s.path(file)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// Releases returns the releases in the directory, oldest first
+func (s *LocalSite) Releases() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.path(ReleasesPrefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var releases []string
+	for _, info := range infos {
+		if info.IsDir() {
+			releases = append(releases, info.Name())
+		}
+	}
+	sort.Strings(releases)
+	return releases, nil
+}
+
+// HasRelease reports whether a release exists in the directory
+func (s *LocalSite) HasRelease(release string) (bool, error) {
+	if release == "" || strings.ContainsAny(release, `/\`) || release == "." || release == ".." {
+		return false, nil
+	}
+	info, err := os.Stat(s.path(ReleaseKey(release, "")))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil && info.IsDir(), err
+}
+
+// Prune deletes all but the newest Keep releases. The live release is
+// always kept. It returns the deleted releases.
+func (s *LocalSite) Prune() ([]string, error) {
+	current, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	releases, err := s.Releases()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, release := range PruneCandidates(releases, current, s.Keep) {
+		if err := os.RemoveAll(s.path(ReleaseKey(release, ""))); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, release)
+	}
+	return pruned, nil
+}
+
+// copyFileAtomic replaces a file with a copy of src, so readers see either
+// the old or the new content
+func copyFileAtomic(src, dst string) error {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, buf)
+}
+
+// writeFileAtomic replaces a file by renaming a temporary file over it,
+// so readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSite writes a generated site to a new temporary directory
+func writeSite(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "public-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLocalSitePromote(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "sites-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	staging := &LocalSite{Dir: filepath.Join(root, "preview"), URL: "http://localhost:1313/", Keep: 2, Preserve: []string{"files/"}}
+	live := &LocalSite{Dir: filepath.Join(root, "live"), URL: "http://localhost:8000", Keep: 2}
+	photo := filepath.Join(staging.Dir, "files", "photos", "a.jpg")
+	if err := os.MkdirAll(filepath.Dir(photo), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(photo, []byte("photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	builds := []map[string]string{
+		{"index.html": "one", "css/main.css": "body{}"},
+		{"index.html": "two", "css/main.css": "body{}", "old.html": "old"},
+		{"index.html": `three <link href="http://localhost:1313/css/main.css">`, "css/main.css": "body{}", "page/about/index.html": "about"},
+	}
+	for i, files := range builds {
+		dir := writeSite(t, files)
+		defer os.RemoveAll(dir)
+		release := string(rune('a' + i))
+		if _, err := staging.Publish(dir, release); err != nil {
+			t.Fatal(err)
+		}
+		if err := staging.Activate(release); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := staging.Prune(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := staging.RootURL(), "http://localhost:1313/"; got != want {
+		t.Errorf("RootURL() = %q, want %q", got, want)
+	}
+	releases, err := staging.Releases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(releases, want) {
+		t.Errorf("Releases() = %v, want %v", releases, want)
+	}
+	current, err := staging.Current()
+	if err != nil || current != "c" {
+		t.Errorf("Current() = %q, %v, want c", current, err)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(staging.Dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(index), "three") {
+		t.Errorf("the live release isn't served from the root: %s", index)
+	}
+	if _, err := os.Stat(filepath.Join(staging.Dir, "old.html")); !os.IsNotExist(err) {
+		t.Errorf("file of an old release is still served: %v", err)
+	}
+	if _, err := os.Stat(photo); err != nil {
+		t.Errorf("preserved file was removed: %v", err)
+	}
+
+	if _, err := Promote(staging, live, "a"); err == nil {
+		t.Errorf("Promote() of a pruned release succeeded")
+	}
+	report, err := Promote(staging, live, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Uploaded) != 3 {
+		t.Errorf("Promote() uploaded %v, want 3 files", report.Uploaded)
+	}
+	if current, _ := live.Current(); current != "c" {
+		t.Errorf("live release is %q, want c", current)
+	}
+	about, err := ioutil.ReadFile(filepath.Join(live.Dir, "page", "about", "index.html"))
+	if err != nil || string(about) != "about" {
+		t.Errorf("promoted release is missing page/about: %q, %v", about, err)
+	}
+	index, err = ioutil.ReadFile(filepath.Join(live.Dir, "index.html"))
+	if err != nil || !strings.Contains(string(index), `href="http://localhost:8000/css/main.css"`) {
+		t.Errorf("promoted release's URLs weren't rewritten: %q, %v", index, err)
+	}
+	if ok, _ := live.HasRelease("b"); ok {
+		t.Errorf("release b was promoted")
+	}
+	if ok, _ := live.HasRelease(".."); ok {
+		t.Errorf("HasRelease(..) = true")
+	}
+}
+
+func TestLocalSiteActivateRestoresOnFailure(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "sites-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	site := &LocalSite{Dir: root, URL: "http://localhost:8000", Keep: 2}
+	builds := []map[string]string{
+		{"index.html": "one", "css/main.css": "one{}", "a.html": "a"},
+		{"index.html": "two", "css/main.css": "two{}", "js/new.js": "new"},
+	}
+	for i, files := range builds {
+		dir := writeSite(t, files)
+		defer os.RemoveAll(dir)
+		if _, err := site.Publish(dir, string(rune('a'+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := site.Activate("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy of the second file fails, after the first was replaced
+	copies := 0
+	site.copyFile = func(src, dst string) error {
+		copies++
+		if copies == 2 {
+			return errors.New("disk full")
+		}
+		return copyFileAtomic(src, dst)
+	}
+	if err := site.Activate("b"); err == nil {
+		t.Fatal("Activate() succeeded with a failing copy")
+	}
+	if current, err := site.Current(); err != nil || current != "a" {
+		t.Errorf("Current() = %q, %v, want a", current, err)
+	}
+	live, err := hashTree(root, func(rel string) bool {
+		return isLiveFile(rel+"/", nil) && isLiveFile(rel, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := HashTree(site.path(ReleaseKey("a", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(live, want) {
+		t.Errorf("live files = %v after a failed activation, want release a's %v", live, want)
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -16,6 +20,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/gorilla/mux"
 )
 
@@ -31,10 +36,67 @@ var PhotoBucket string
 // SiteBucket hosts the static files for the website
 var SiteBucket string
 
-var listenPort = flag.Int("port", 8080, "Port to listen on")
+// BurstWindow is the longest gap between near-identical photos that are
+// collapsed into a single burst entry. Bursts are disabled when it's zero.
+var BurstWindow time.Duration
+
+// BurstDistance is the largest perceptual hash distance, in bits,
+// between photos considered near-identical
+var BurstDistance = 10
+
+// BuildDebounce is how long the updater waits for further update requests
+// before starting a build
+var BuildDebounce = 2 * time.Second
+
+// SiteURL is the public URL of the SiteBucket
+var SiteURL = "https://photos.czan.io"
+
+// ReleasesKept is how many releases are kept in the SiteBucket for rollbacks
+var ReleasesKept = 5
+
+// production is the live site
+var production Target
+
+// preview is where builds are published for review before they're promoted
+// to production. Builds go straight to production when it's nil.
+var preview Target
+
+// SiteDir is the Hugo site the gallery is built from
+var SiteDir = "."
+
+// BuildTimeout is the longest a build may run before it's canceled
+var BuildTimeout = 5 * time.Minute
+
+// catalog is the photo catalog builds read from. Builds read the metadata
+// of every photo in the bucket when it's nil.
+var catalog *Catalog
+
+// builder serializes the builds requested through UpdateHandler
+var builder *Builder
+
+// WatchInterval is how often the local photo directory is scanned for changes
+// when file system notifications aren't available
+var WatchInterval = 2 * time.Second
+
+// EventPollInterval is how long the updater waits between polls of an
+// empty event queue
+var EventPollInterval = 10 * time.Second
+
+// verifier checks the signatures of update, rollback and promote requests.
+// It's only nil in local mode with -allow-unsigned.
+var verifier *Verifier
+
+var (
+	listenPort     = flag.Int("port", 8080, "Port to listen on")
+	reconcile      = flag.Bool("reconcile", false, "Compare the catalog to the photo bucket, print the differences and exit")
+	rebuildCatalog = flag.Bool("rebuild-catalog", false, "Rebuild the catalog from the photo bucket's object metadata and exit")
+	allowUnsigned  = flag.Bool("allow-unsigned", false, "Accept unsigned requests when UPDATE_SECRET isn't set. Only allowed with PHOTO_DIR")
+)
 
 func main() {
 
+	flag.Parse()
+
 	PhotoBucket = os.Getenv("PHOTO_BUCKET")
 	SiteBucket = os.Getenv("SITE_BUCKET")
 	awsRegion := os.Getenv("AWS_REGION")
@@ -42,177 +104,403 @@ func main() {
 		log.Printf("AWS_REGION not set. Defaulting to us-east-1")
 		os.Setenv("AWS_REGION", "us-east-1")
 	}
-	if PhotoBucket == "" {
-		log.Fatalf("PHOTO_BUCKET environment variable not set!")
+	if window := os.Getenv("BURST_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Invalid BURST_WINDOW: %s", err)
+		}
+		BurstWindow = d
+	}
+	if distance := os.Getenv("BURST_DISTANCE"); distance != "" {
+		d, err := strconv.Atoi(distance)
+		if err != nil {
+			log.Fatalf("Invalid BURST_DISTANCE: %s", err)
+		}
+		BurstDistance = d
+	}
+	if debounce := os.Getenv("BUILD_DEBOUNCE"); debounce != "" {
+		d, err := time.ParseDuration(debounce)
+		if err != nil {
+			log.Fatalf("Invalid BUILD_DEBOUNCE: %s", err)
+		}
+		BuildDebounce = d
+	}
+	if url := os.Getenv("SITE_URL"); url != "" {
+		SiteURL = url
 	}
-	if SiteBucket == "" {
-		log.Fatalf("SITE_BUCKET environment variable not set!")
+	if keep := os.Getenv("RELEASES_KEPT"); keep != "" {
+		n, err := strconv.Atoi(keep)
+		if err != nil {
+			log.Fatalf("Invalid RELEASES_KEPT: %s", err)
+		}
+		ReleasesKept = n
 	}
-	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key == "" {
-		log.Fatalf("AWS_ACCESS_KEY_ID not set!")
+	previewKeep := ReleasesKept
+	if keep := os.Getenv("PREVIEW_RELEASES_KEPT"); keep != "" {
+		n, err := strconv.Atoi(keep)
+		if err != nil {
+			log.Fatalf("Invalid PREVIEW_RELEASES_KEPT: %s", err)
+		}
+		previewKeep = n
+	}
+	previewURL := os.Getenv("PREVIEW_URL")
+	if bucket := os.Getenv("PREVIEW_BUCKET"); bucket != "" {
+		if previewURL == "" {
+			log.Fatalf("PREVIEW_URL must be set with PREVIEW_BUCKET")
+		}
+		preview = &Site{Bucket: bucket, Prefix: os.Getenv("PREVIEW_PREFIX"), URL: previewURL, Keep: previewKeep}
+	} else if dir := os.Getenv("PREVIEW_DIR"); dir != "" {
+		if previewURL == "" {
+			previewURL = "file://" + dir
+		}
+		preview = &LocalSite{Dir: dir, URL: previewURL, Keep: previewKeep}
+	}
+	if path := os.Getenv("CATALOG_FILE"); path != "" {
+		c, err := OpenCatalog(path)
+		if err != nil {
+			log.Fatalf("Unable to open catalog: %s", err)
+		}
+		catalog = c
+	}
+	if dir := os.Getenv("SITE_DIR"); dir != "" {
+		SiteDir = dir
+	}
+	if workers := os.Getenv("METADATA_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil {
+			log.Fatalf("Invalid METADATA_WORKERS: %s", err)
+		}
+		MetadataWorkers = n
+	}
+	if timeout := os.Getenv("BUILD_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("Invalid BUILD_TIMEOUT: %s", err)
+		}
+		BuildTimeout = d
 	}
-	if key := os.Getenv("AWS_SECRET_ACCESS_KEY"); key == "" {
-		log.Fatalf("AWS_SECRET_ACCESS_KEY not set!")
+	if secret := os.Getenv("UPDATE_SECRET"); secret != "" {
+		verifier = NewVerifier(secret, SignatureMaxAge)
+	}
+	EventsToken = os.Getenv("EVENTS_TOKEN")
+	if interval := os.Getenv("EVENT_POLL_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid EVENT_POLL_INTERVAL: %s", err)
+		}
+		EventPollInterval = d
+	}
+	var events EventQueue
+	if url := os.Getenv("EVENT_QUEUE_URL"); url != "" {
+		events = &SQSQueue{Svc: sqs.New(session.Must(session.NewSession())), URL: url}
+	} else if dir := os.Getenv("EVENT_QUEUE_DIR"); dir != "" {
+		events = &FileQueue{Dir: dir}
+	}
+	var certs *CertReloader
+	tlsFiles := TLSFiles{
+		Cert:     os.Getenv("TLS_CERT_FILE"),
+		Key:      os.Getenv("TLS_KEY_FILE"),
+		ClientCA: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+	if tlsFiles != (TLSFiles{}) {
+		c, err := NewCertReloader(tlsFiles)
+		if err != nil {
+			log.Fatalf("Unable to load TLS files: %s", err)
+		}
+		certs = c
+	}
+	if interval := os.Getenv("WATCH_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid WATCH_INTERVAL: %s", err)
+		}
+		WatchInterval = d
+	}
+	if dir := os.Getenv("PHOTO_DIR"); dir != "" {
+		// Local mode: photos are read from a directory and the site is
+		// published to another, so there's nothing to read from AWS
+		output := os.Getenv("OUTPUT_DIR")
+		if output == "" {
+			log.Fatalf("OUTPUT_DIR must be set with PHOTO_DIR")
+		}
+		localPhotos = &LocalPhotos{Dir: dir, Files: filepath.Join(output, "files")}
+		siteURL := os.Getenv("SITE_URL")
+		if siteURL == "" {
+			siteURL = "file://" + output
+		}
+		// Photos are copied into the site, so they're served from its root
+		FilesURL = strings.TrimSuffix(siteURL, "/") + "/files/"
+		production = &LocalSite{Dir: output, URL: siteURL, Keep: ReleasesKept, Preserve: []string{"files/"}}
+		if catalog != nil {
+			// The catalog is kept from the photo bucket's journal, which
+			// local mode doesn't read
+			log.Fatalf("CATALOG_FILE can't be used with PHOTO_DIR")
+		}
+	} else {
+		if PhotoBucket == "" {
+			log.Fatalf("PHOTO_BUCKET environment variable not set!")
+		}
+		if SiteBucket == "" {
+			log.Fatalf("SITE_BUCKET environment variable not set!")
+		}
+		if key := os.Getenv("AWS_ACCESS_KEY_ID"); key == "" {
+			log.Fatalf("AWS_ACCESS_KEY_ID not set!")
+		}
+		if key := os.Getenv("AWS_SECRET_ACCESS_KEY"); key == "" {
+			log.Fatalf("AWS_SECRET_ACCESS_KEY not set!")
+		}
+		site := &Site{Bucket: SiteBucket, URL: SiteURL, Keep: ReleasesKept}
+		// A preview in the same bucket mustn't be removed from the live site's root
+		if p, ok := preview.(*Site); ok && p.Bucket == SiteBucket {
+			if p.Prefix == "" {
+				log.Fatalf("PREVIEW_PREFIX must be set when PREVIEW_BUCKET is SITE_BUCKET")
+			}
+			site.Preserve = []string{p.Prefix}
+		}
+		production = site
+	}
+
+	if *reconcile || *rebuildCatalog {
+		if localPhotos != nil {
+			log.Fatalf("The catalog isn't used with PHOTO_DIR")
+		}
+		if catalog == nil {
+			log.Fatalf("CATALOG_FILE environment variable not set!")
+		}
+		if err := maintainCatalog(catalog, *rebuildCatalog); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if verifier == nil {
+		if !*allowUnsigned || localPhotos == nil {
+			log.Fatalf("UPDATE_SECRET environment variable not set!")
+		}
+		log.Printf("UPDATE_SECRET not set. Requests won't be authenticated")
 	}
 
 	// Grab Destination Bucket from Environment
 	// Grab AWS Credentials from Environment
 	r := mux.NewRouter()
+	builder = NewBuilder(BuildGallery, BuildDebounce)
 
 	fmt.Printf("AWS Region: %s\n", awsRegion)
 
-	r.HandleFunc("/update", UpdateHandler)
+	r.HandleFunc("/update", RequireSignature(verifier, UpdateHandler))
+	// Build records include Hugo output and the keys of changed photos
+	r.HandleFunc("/builds", RequireSignature(verifier, BuildsHandler)).Methods("GET")
+	r.HandleFunc("/builds/{id}", RequireSignature(verifier, BuildHandler)).Methods("GET")
+	r.HandleFunc("/rollback/{build}", RequireSignature(verifier, RollbackHandler)).Methods("POST")
+	r.HandleFunc("/promote/{build}", RequireSignature(verifier, PromoteHandler)).Methods("POST")
+	if EventsToken != "" {
+		r.HandleFunc("/events", EventsHandler).Methods("POST")
+	}
+
+	if events != nil {
+		go PollEvents(context.Background(), events, EventPollInterval, builder.Trigger)
+	}
+	if localPhotos != nil {
+		log.Printf("Watching %s for photos", localPhotos.Dir)
+		go Watch(context.Background(), NewWatcher(localPhotos), WatchInterval, builder.Trigger)
+	}
 
+	// The write timeout is long enough for /update?wait=true to block until the build completes
 	srv := &http.Server{
 		Handler:      r,
 		Addr:         ":" + strconv.Itoa(*listenPort),
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: 10 * time.Minute,
 		ReadTimeout:  10 * time.Second,
 	}
 
+	if certs != nil {
+		srv.TLSConfig = certs.ServerConfig()
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
 	log.Fatal(srv.ListenAndServe())
 }
 
-// S3ListObjects lists the photos in the destination bucket
+// S3ListObjects lists the photos in the destination bucket, reading every
+// page of the listing
 func S3ListObjects(bucket string) (*s3.ListObjectsV2Output, error) {
-	svc := s3.New(session.New())
-	input := &s3.ListObjectsV2Input{
+	result := &s3.ListObjectsV2Output{}
+	err := s3Client().ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String("photos/"),
-	}
-
-	result, err := svc.ListObjectsV2(input)
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		result.Contents = append(result.Contents, page.Contents...)
+		return true
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				fmt.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return result, nil
+		return nil, fmt.Errorf("unable to list %s: %s", bucket, err)
 	}
-
-	//fmt.Printf("Result: %+v", result)
 	return result, nil
 }
 
 // S3GetMetadata returns the metadata of an object
 func S3GetMetadata(key string) (*s3.HeadObjectOutput, error) {
-	svc := s3.New(session.New())
-	input := &s3.HeadObjectInput{
+	return s3Client().HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(PhotoBucket),
 		Key:    aws.String(key),
-	}
+	})
+}
 
-	result, err := svc.HeadObject(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-	}
-	//fmt.Println(result)
-	return result, nil
+// Entry is a photo or video shown in the gallery
+type Entry struct {
+	Key           string
+	Kind          string
+	ContentType   string
+	Caption       string
+	Poster        string
+	VoiceCaptions []string
+	Size          int64
+	Width         int
+	Height        int
+	Taken         time.Time
+	Uploaded      time.Time
+	Album         string
+	PHash         uint64
+	HasPHash      bool
+	Sharpness     float64
+	// Collage is the key of the collage composed from this photo's message
+	Collage string
+
+	// Burst holds the other near-identical shots when this entry is a burst cover
+	Burst []*Entry
 }
 
-// ParseObjects returns the parsed figure lines
-func ParseObjects(o *s3.ListObjectsV2Output) ([]string, error) {
-	result := []string{}
-	contents := o.Contents
-	for _, o := range contents {
-		if *o.Key == "photos/" {
+// ParseObjects returns the gallery entries for the objects in the bucket.
+// Their metadata is fetched concurrently and cached across builds. It fails
+// if the metadata of any object can't be read, rather than leave it out, and
+// only drops objects that are no longer listed from the cache when it succeeds.
+func ParseObjects(o *s3.ListObjectsV2Output) ([]*Entry, *FetchStats, error) {
+	var objects []*s3.Object
+	listed := map[string]bool{}
+	for _, obj := range o.Contents {
+		if *obj.Key == "photos/" {
 			continue
 		}
-		obj, err := S3GetMetadata(*o.Key)
-		if err != nil {
-			fmt.Println(err)
-		}
-		//fmt.Println(obj.Metadata)
-		var caption string
-		if c := obj.Metadata["Caption"]; c != nil {
-			caption = *c
+		objects = append(objects, obj)
+		listed[*obj.Key] = true
+	}
+	heads, stats := objectMetadata.Fetch(objects, MetadataWorkers, S3GetMetadata)
+	if stats.Failed > 0 {
+		// The cache is kept as it is, so the next build only fetches what failed
+		for i, obj := range objects {
+			if heads[i] == nil {
+				return nil, stats, fmt.Errorf("unable to read the metadata of %d objects, including %s", stats.Failed, *obj.Key)
+			}
 		}
-		line := fmt.Sprintf(`{{< figure link="https://files.czan.io/%s" caption="%s" >}}`, *o.Key, caption)
-		result = append(result, line)
 	}
-	return result, nil
+	objectMetadata.Forget(listed)
+
+	result := []*Entry{}
+	for i, obj := range objects {
+		result = append(result, NewEntry(*obj.Key, heads[i]))
+	}
+	return result, stats, nil
 }
 
-// GenerateManifest creates the Hugo manifest
-func GenerateManifest(objects []string) {
-	filename := "content/_index.md"
-	manifest := []string{
-		`####`,
-		"",
-		`{{< gallery >}}`,
+// NewEntry creates a gallery entry from an object's metadata
+func NewEntry(key string, obj *s3.HeadObjectOutput) *Entry {
+	e := &Entry{
+		Key:         key,
+		Kind:        MediaKind(obj),
+		ContentType: aws.StringValue(obj.ContentType),
+		Size:        aws.Int64Value(obj.ContentLength),
+		Taken:       aws.TimeValue(obj.LastModified),
+		Uploaded:    aws.TimeValue(obj.LastModified),
 	}
-	manifest = append(manifest, objects...)
-	manifest = append(manifest, `{{< /gallery >}}`)
-	for _, line := range manifest {
-		fmt.Printf("%s\n", line)
+	if c := obj.Metadata["Caption"]; c != nil {
+		e.Caption = *c
 	}
-	if _, err := os.Stat(filename); err == nil {
-		_ = os.Remove(filename)
+	// The uploader files each photo under an album when it's uploaded
+	e.Album = DefaultAlbum
+	if a := obj.Metadata["Album"]; a != nil && *a != "" {
+		e.Album = *a
 	}
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-
-	if err != nil {
-		log.Fatalf("failed creating file: %s", err)
+	if w := obj.Metadata["Width"]; w != nil {
+		e.Width, _ = strconv.Atoi(*w)
 	}
-
-	datawriter := bufio.NewWriter(file)
-
-	for _, data := range manifest {
-		_, _ = datawriter.WriteString(data + "\n")
+	if h := obj.Metadata["Height"]; h != nil {
+		e.Height, _ = strconv.Atoi(*h)
 	}
-
-	datawriter.Flush()
-	file.Close()
+	if p := obj.Metadata["Poster"]; p != nil {
+		e.Poster = *p
+	}
+	if v := obj.Metadata["Voice-Caption"]; v != nil && *v != "" {
+		e.VoiceCaptions = strings.Split(*v, ",")
+	}
+	if t := obj.Metadata["Taken"]; t != nil {
+		if taken, err := time.Parse(time.RFC3339, *t); err == nil {
+			e.Taken = taken
+		}
+	}
+	if h := obj.Metadata["Phash"]; h != nil {
+		if hash, err := strconv.ParseUint(*h, 16, 64); err == nil {
+			e.PHash, e.HasPHash = hash, true
+		}
+	}
+	if v := obj.Metadata["Sharpness"]; v != nil {
+		e.Sharpness, _ = strconv.ParseFloat(*v, 64)
+	}
+	if c := obj.Metadata["Collage"]; c != nil {
+		e.Collage = *c
+	}
+	return e
 }
 
-// HugoMinify runs hugo --minify
-func HugoMinify() {
-	cmd := exec.Command("hugo", "--minify")
-	log.Println("Running Hugo..")
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println(err)
+// Media kinds of the entries in the manifest
+const (
+	MediaKindImage = "image"
+	MediaKindVideo = "video"
+)
+
+// MediaKind returns the kind of manifest entry for an object.
+// Objects uploaded before the "kind" metadata existed fall back to their Content-Type
+func MediaKind(obj *s3.HeadObjectOutput) string {
+	if k := obj.Metadata["Kind"]; k != nil && *k != "" {
+		return *k
 	}
+	if strings.HasPrefix(aws.StringValue(obj.ContentType), "video/") {
+		return MediaKindVideo
+	}
+	return MediaKindImage
 }
 
-// UploadIndex uploads the index file to S3
-func UploadIndex() error {
-	filename := "public/index.html"
-	f, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open file %q, %v", filename, err)
+// GenerateManifest creates the Hugo manifest. The gallery itself is
+// rendered by the home page layout from data/photos.json.
+// shareImage is the URL of the link preview image, if any.
+func GenerateManifest(dir string, shareImage string) error {
+	manifest := []string{}
+	if shareImage != "" {
+		manifest = append(manifest,
+			"---",
+			fmt.Sprintf("share_img: %q", shareImage),
+			"---",
+		)
 	}
-
-	contentType := "text/html"
-	uploadInput := &s3manager.UploadInput{
-		Body:        f,
-		Bucket:      aws.String(SiteBucket),
-		Key:         aws.String("index.html"),
-		ACL:         aws.String("public-read"),
-		ContentType: &contentType,
+	manifest = append(manifest, `####`, "")
+	filename := filepath.Join(dir, "content/_index.md")
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(manifest, "\n")), 0644); err != nil {
+		return fmt.Errorf("failed creating file: %s", err)
 	}
-	err = S3UploadFile(uploadInput)
+	return nil
+}
+
+// HugoMinify runs hugo --minify on the site in dir and returns its output.
+// The site is built for baseURL. Hugo is killed if ctx is done before it finishes.
+func HugoMinify(ctx context.Context, dir, baseURL string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "hugo", "--minify", "--source", dir, "--baseURL", baseURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.Println("Running Hugo..")
+	err := cmd.Run()
 	if err != nil {
 		fmt.Println(err)
 	}
-	return nil
+	return stdout.String(), stderr.String(), err
 }
 
 // S3UploadFile writes a file to a destination bucket
@@ -231,29 +519,136 @@ func S3UploadFile(input *s3manager.UploadInput) error {
 			// Message from an error.
 			fmt.Println(err.Error())
 		}
-		return nil
+		return err
 	}
 	log.Println(result)
 	return nil
 }
 
-// UpdateHandler accepts inbound MMS messages and copies media to S3
-func UpdateHandler(w http.ResponseWriter, r *http.Request) {
-
-	// List all files in the Bucket
-	objects, err := S3ListObjects(PhotoBucket)
+// BuildGallery regenerates the gallery from the photos in the bucket and
+// publishes it as the release of build id, to preview if it's set and
+// to production otherwise. Unless changes is a full rebuild, only the
+// metadata of the changed photos is read.
+// The site is built in a private copy of SiteDir, so a failed or canceled
+// build never leaves a half-written site behind.
+func BuildGallery(ctx context.Context, id string, changes *Changes) (*BuildResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, BuildTimeout)
+	defer cancel()
+	metrics := NewBuildMetrics()
+	started := time.Now()
+	defer func() {
+		metrics.Time("total", started)
+		log.Printf("Build %s timings: %v", id, metrics.Stages)
+	}()
+
+	stage := time.Now()
+	dir, err := NewWorkspace(SiteDir)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+	defer os.RemoveAll(dir)
+	metrics.Time("workspace", stage)
+
+	var entries []*Entry
+	if localPhotos != nil {
+		stage = time.Now()
+		entries, err = loadLocalPhotos(localPhotos, changes)
+		metrics.Time("photos", stage)
+	} else if catalog != nil {
+		stage = time.Now()
+		entries, err = loadCatalog(catalog, changes)
+		metrics.Time("catalog", stage)
+	} else if !changes.Full && photoIndex.Ready() {
+		stage = time.Now()
+		err = photoIndex.Apply(changes, S3Entry)
+		entries = photoIndex.Entries()
+		metrics.Time("changes", stage)
+	} else {
+		// List all files in the Bucket
+		stage = time.Now()
+		var objects *s3.ListObjectsV2Output
+		objects, err = S3ListObjects(PhotoBucket)
+		metrics.Time("list", stage)
+
+		// For each file, grab the name and metadata, and add it to a slice of string
+		if err == nil {
+			stage = time.Now()
+			entries, metrics.Metadata, err = ParseObjects(objects)
+			if err == nil {
+				photoIndex.Replace(entries)
+				entries = photoIndex.Entries()
+			}
+			metrics.Time("metadata", stage)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := &BuildResult{Photos: len(entries), Metrics: metrics}
+	stage = time.Now()
+	SortEntries(entries)
+	if BurstWindow > 0 {
+		entries = CollapseBursts(entries, BurstWindow, BurstDistance)
+	}
+	entries = AddCollageCovers(entries, func(key string) *Entry {
+		if catalog != nil {
+			if e := catalog.Entry(key); e != nil {
+				return e
+			}
+		}
+		obj, err := S3GetMetadata(key)
+		if err != nil || obj.LastModified == nil {
+			return nil
+		}
+		return NewEntry(key, obj)
+	})
 
-	// For each file, grab the name and metadata, and add it to a slice of string
-	lines, err := ParseObjects(objects)
-
-	GenerateManifest(lines)
-	HugoMinify()
-	UploadIndex()
+	var shareImage string
+	if key := ShareImage(entries); key != "" {
+		shareImage = fileURL(key)
+	}
+	if err := GenerateManifest(dir, shareImage); err != nil {
+		return result, err
+	}
+	if err := WritePhotosData(dir, NewPhotosData(entries, shareImage, time.Now())); err != nil {
+		return result, err
+	}
+	metrics.Time("manifest", stage)
 
-	w.WriteHeader(http.StatusOK)
-	//json, _ := json.MarshalIndent(resp, "", "  ")
-	fmt.Fprintf(w, "%s", "OK")
+	target := production
+	if preview != nil {
+		target = preview
+	}
+	stage = time.Now()
+	result.Stdout, result.Stderr, err = HugoMinify(ctx, dir, target.RootURL())
+	metrics.Time("hugo", stage)
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err != nil {
+		return result, fmt.Errorf("hugo failed: %v", err)
+	}
+	if preview == nil {
+		releaseMu.Lock()
+		defer releaseMu.Unlock()
+	}
+	stage = time.Now()
+	result.Sync, err = target.Publish(filepath.Join(dir, "public"), id)
+	metrics.Time("publish", stage)
+	if err != nil {
+		return result, err
+	}
+	if err := target.Activate(id); err != nil {
+		return result, err
+	}
+	result.Release = id
+	if preview != nil {
+		result.Preview = preview.RootURL()
+	}
+	if pruned, err := target.Prune(); err != nil {
+		log.Printf("Unable to prune releases: %s", err)
+	} else if len(pruned) > 0 {
+		log.Printf("Pruned releases %v", pruned)
+	}
+	return result, nil
 }
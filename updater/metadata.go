@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// MetadataWorkers is how many objects' metadata is fetched at once
+var MetadataWorkers = 8
+
+var (
+	s3Once sync.Once
+	s3Svc  *s3.S3
+)
+
+// s3Client returns the S3 client shared by the updater's photo bucket requests
+func s3Client() *s3.S3 {
+	s3Once.Do(func() {
+		s3Svc = s3.New(session.Must(session.NewSession()))
+	})
+	return s3Svc
+}
+
+// FetchStats counts where the metadata of a build's objects came from
+type FetchStats struct {
+	Fetched int `json:"fetched"`
+	Cached  int `json:"cached"`
+	Failed  int `json:"failed"`
+}
+
+// MetadataCache holds the metadata of objects across builds, so objects
+// that haven't changed since the last build aren't fetched again
+type MetadataCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedMetadata
+}
+
+// cachedMetadata is the metadata of one version of an object
+type cachedMetadata struct {
+	version string
+	head    *s3.HeadObjectOutput
+}
+
+// NewMetadataCache creates an empty cache
+func NewMetadataCache() *MetadataCache {
+	return &MetadataCache{entries: map[string]cachedMetadata{}}
+}
+
+// objectMetadata caches the metadata of the photo bucket's objects
+var objectMetadata = NewMetadataCache()
+
+// objectVersion identifies the version of a listed object. Replacing an
+// object's metadata copies it onto itself, which keeps its ETag, so the
+// modification time is part of the version too.
+func objectVersion(o *s3.Object) string {
+	return aws.StringValue(o.ETag) + "@" + aws.TimeValue(o.LastModified).UTC().Format(time.RFC3339Nano)
+}
+
+// Fetch returns the metadata of objects, in order, fetching it with up to
+// workers concurrent calls to fetch. Only objects that aren't cached at their
+// listed version are fetched. Objects whose metadata can't be read are nil.
+func (c *MetadataCache) Fetch(objects []*s3.Object, workers int, fetch func(key string) (*s3.HeadObjectOutput, error)) ([]*s3.HeadObjectOutput, *FetchStats) {
+	result := make([]*s3.HeadObjectOutput, len(objects))
+	stats := &FetchStats{}
+	var missing []int
+	c.mu.Lock()
+	for i, o := range objects {
+		if cached, ok := c.entries[*o.Key]; ok && cached.version == objectVersion(o) {
+			result[i] = cached.head
+			stats.Cached++
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	c.mu.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for w := 0; w < workers && w < len(missing); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				o := objects[i]
+				head, err := fetch(*o.Key)
+				mu.Lock()
+				if err != nil || head == nil {
+					stats.Failed++
+				} else {
+					stats.Fetched++
+					result[i] = head
+				}
+				mu.Unlock()
+				if err == nil && head != nil {
+					c.mu.Lock()
+					c.entries[*o.Key] = cachedMetadata{version: objectVersion(o), head: head}
+					c.mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, i := range missing {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return result, stats
+}
+
+// Forget drops the cached metadata of keys that aren't in keep
+func (c *MetadataCache) Forget(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if !keep[key] {
+			delete(c.entries, key)
+		}
+	}
+}
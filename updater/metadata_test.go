@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestMetadataCacheFetch(t *testing.T) {
+
+	modified := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	var objects []*s3.Object
+	for i := 0; i < 20; i++ {
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(fmt.Sprintf("photos/%02d", i)),
+			ETag:         aws.String(fmt.Sprintf("\"etag-%d\"", i)),
+			LastModified: aws.Time(modified),
+		})
+	}
+
+	var mu sync.Mutex
+	var calls, running, peak int
+	fetch := func(key string) (*s3.HeadObjectOutput, error) {
+		mu.Lock()
+		calls++
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if key == "photos/13" {
+			return nil, errors.New("access denied")
+		}
+		return &s3.HeadObjectOutput{Metadata: map[string]*string{"Caption": aws.String(key)}}, nil
+	}
+
+	cache := NewMetadataCache()
+	heads, stats := cache.Fetch(objects, 4, fetch)
+	if calls != 20 || stats.Fetched != 19 || stats.Failed != 1 || stats.Cached != 0 {
+		t.Fatalf("first fetch: %d calls, stats %+v", calls, stats)
+	}
+	if peak > 4 {
+		t.Errorf("%d concurrent fetches, want at most 4", peak)
+	}
+	for i, head := range heads {
+		if i == 13 {
+			if head != nil {
+				t.Errorf("failed object has metadata %v", head)
+			}
+			continue
+		}
+		if got := aws.StringValue(head.Metadata["Caption"]); got != *objects[i].Key {
+			t.Errorf("metadata %d is for %s", i, got)
+		}
+	}
+
+	// Only the failed object and the one whose metadata was replaced are fetched again
+	calls = 0
+	objects[2].LastModified = aws.Time(modified.Add(time.Minute))
+	_, stats = cache.Fetch(objects, 4, fetch)
+	if calls != 2 || stats.Cached != 18 {
+		t.Errorf("second fetch: %d calls, stats %+v", calls, stats)
+	}
+
+	cache.Forget(map[string]bool{"photos/00": true})
+	calls = 0
+	_, stats = cache.Fetch(objects[:2], 4, fetch)
+	if calls != 1 || stats.Cached != 1 {
+		t.Errorf("fetch after forget: %d calls, stats %+v", calls, stats)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// photoStorePrefixes are the prefixes of the objects the catalog describes
+var photoStorePrefixes = []string{"photos/", "collages/"}
+
+// ReconcileReport describes how the catalog and the photo bucket differ
+type ReconcileReport struct {
+	// Checked is how many objects are in the bucket
+	Checked int `json:"checked"`
+	// Orphans are objects the catalog doesn't know about
+	Orphans []string `json:"orphans"`
+	// Missing are catalog records whose object no longer exists
+	Missing []string `json:"missing"`
+	// Changed are objects whose size differs from their record
+	Changed []string `json:"changed"`
+}
+
+// Clean reports whether the catalog and the bucket agree
+func (r *ReconcileReport) Clean() bool {
+	return len(r.Orphans) == 0 && len(r.Missing) == 0 && len(r.Changed) == 0
+}
+
+// Reconcile compares catalog records to the objects in the photo store,
+// given as their sizes keyed by object key
+func Reconcile(records []*CatalogRecord, objects map[string]int64) *ReconcileReport {
+	report := &ReconcileReport{
+		Checked: len(objects),
+		Orphans: []string{},
+		Missing: []string{},
+		Changed: []string{},
+	}
+	recorded := map[string]bool{}
+	for _, r := range records {
+		if r.Deleted {
+			continue
+		}
+		recorded[r.Key] = true
+		size, ok := objects[r.Key]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, r.Key)
+		case size != r.Size:
+			report.Changed = append(report.Changed, r.Key)
+		}
+	}
+	for key := range objects {
+		if !recorded[key] {
+			report.Orphans = append(report.Orphans, key)
+		}
+	}
+	sort.Strings(report.Orphans)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Changed)
+	return report
+}
+
+// S3ListPhotoStore lists the objects the catalog describes
+func S3ListPhotoStore(bucket string) ([]*s3.Object, error) {
+	svc := s3Client()
+	var objects []*s3.Object
+	for _, prefix := range photoStorePrefixes {
+		err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, o := range page.Contents {
+				if !strings.HasSuffix(aws.StringValue(o.Key), "/") {
+					objects = append(objects, o)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// ReconcileCatalog compares a catalog to the photo bucket
+func ReconcileCatalog(c *Catalog) (*ReconcileReport, error) {
+	objects, err := S3ListPhotoStore(PhotoBucket)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, o := range objects {
+		sizes[*o.Key] = aws.Int64Value(o.Size)
+	}
+	return Reconcile(c.Records(), sizes), nil
+}
+
+// RebuildCatalog replaces the content of a catalog with records created
+// from the metadata of the objects in the photo bucket, for when the catalog
+// is lost or can't be trusted, and then replays the journal to restore what
+// only it records. It returns how many objects were listed.
+func RebuildCatalog(c *Catalog, j Journal) (int, error) {
+	listed := time.Now()
+	objects, err := S3ListPhotoStore(PhotoBucket)
+	if err != nil {
+		return 0, err
+	}
+	entries, _, err := ParseObjects(&s3.ListObjectsV2Output{Contents: objects})
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), reseedCatalog(c, entries, listed, j)
+}
+
+// reseedCatalog replaces the content of a catalog with the entries of a
+// listing started at listed, and replays the journal. Photos the journal
+// recorded before the listing that aren't in it have been deleted, so they
+// aren't added back.
+func reseedCatalog(c *Catalog, entries []*Entry, listed time.Time, j Journal) error {
+	c.Reset()
+	c.Seed(entries, listed)
+	if err := c.Save(); err != nil {
+		return err
+	}
+	applied, err := c.Sync(j)
+	if err != nil {
+		return err
+	}
+	log.Printf("Applied %d catalog changes", applied)
+	return nil
+}
+
+// maintainCatalog runs the -reconcile and -rebuild-catalog commands. The
+// catalog is rebuilt first if asked, then compared to the bucket, and the
+// report is printed as JSON. It fails if the catalog and bucket disagree.
+func maintainCatalog(c *Catalog, rebuild bool) error {
+	if rebuild {
+		n, err := RebuildCatalog(c, &S3Journal{Svc: s3Client(), Bucket: PhotoBucket})
+		if err != nil {
+			return err
+		}
+		log.Printf("Rebuilt the catalog with %d objects", n)
+	}
+	report, err := ReconcileCatalog(c)
+	if err != nil {
+		return err
+	}
+	buf, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(buf))
+	if !report.Clean() {
+		return fmt.Errorf("catalog and bucket differ: %d orphans, %d missing, %d changed", len(report.Orphans), len(report.Missing), len(report.Changed))
+	}
+	return nil
+}
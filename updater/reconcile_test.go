@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	records := []*CatalogRecord{
+		{Key: "photos/a", Size: 100},
+		{Key: "photos/b", Size: 200},
+		{Key: "photos/c", Size: 300},
+		{Key: "photos/gone", Size: 1, Deleted: true},
+		{Key: "collages/x", Size: 50},
+	}
+	objects := map[string]int64{
+		"photos/a":   100,
+		"photos/b":   250,
+		"photos/new": 10,
+		"collages/x": 50,
+	}
+	report := Reconcile(records, objects)
+	want := &ReconcileReport{
+		Checked: 4,
+		Orphans: []string{"photos/new"},
+		Missing: []string{"photos/c"},
+		Changed: []string{"photos/b"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Reconcile() = %+v, want %+v", report, want)
+	}
+	if report.Clean() {
+		t.Errorf("Clean() = true")
+	}
+	if report := Reconcile(records[:1], map[string]int64{"photos/a": 100}); !report.Clean() {
+		t.Errorf("Reconcile() of a matching catalog = %+v", report)
+	}
+}
+
+func TestRebuildCatalogSkipsDeletedPhotos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	j := &memJournal{changes: map[string]*CatalogRecord{}}
+	j.add(&CatalogRecord{Key: "photos/a", Kind: MediaKindImage, Size: 100, Sender: "+15550001111", Updated: uploaded})
+	// photos/b was deleted from the bucket without a journal record
+	j.add(&CatalogRecord{Key: "photos/b", Kind: MediaKindImage, Size: 200, Updated: uploaded})
+	listed := uploaded.Add(time.Hour)
+	// photos/c was uploaded while the bucket was being listed
+	j.add(&CatalogRecord{Key: "photos/c", Kind: MediaKindImage, Size: 300, Updated: listed.Add(time.Second)})
+
+	entries := []*Entry{{Key: "photos/a", Kind: MediaKindImage, Size: 100, Uploaded: uploaded}}
+	if err := reseedCatalog(c, entries, listed, j); err != nil {
+		t.Fatal(err)
+	}
+	if r := c.Record("photos/a"); r == nil || r.Sender != "+15550001111" {
+		t.Errorf("journal fields weren't restored: %+v", r)
+	}
+	report := Reconcile(c.Records(), map[string]int64{"photos/a": 100, "photos/c": 300})
+	if !report.Clean() {
+		t.Errorf("report after a rebuild isn't clean: %+v", report)
+	}
+}
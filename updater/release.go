@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ReleasesPrefix is where releases are stored in a site bucket
+const ReleasesPrefix = "releases/"
+
+// pointerKey is the object recording the live release of a site
+const pointerKey = "current.json"
+
+// Target is somewhere the gallery is published to. Each build is published
+// in full as its own release, and only then is it made live by copying its
+// files to the target's root, so the site is always served at the same URLs
+// and old releases can be pruned without breaking links to it.
+//
+// Releases are built for the root URL of the target they're published to.
+// A release promoted to another target has its URLs rewritten to that one's.
+type Target interface {
+	// RootURL returns the URL the live release is served at
+	RootURL() string
+	// Publish adds the generated site in dir as a new release
+	Publish(dir, release string) (*SyncReport, error)
+	// Export copies the files of a release to dir
+	Export(release, dir string) error
+	// Current returns the live release, or an empty string if nothing has been published
+	Current() (string, error)
+	// Activate makes a release live, or keeps the live one if it fails
+	Activate(release string) error
+	// HasRelease reports whether a release exists
+	HasRelease(release string) (bool, error)
+	// Prune deletes old releases and returns them
+	Prune() ([]string, error)
+}
+
+// Site is a bucket, or a prefix in one, the gallery is published to
+type Site struct {
+	Bucket string
+	// Prefix is prepended to every key the site writes
+	Prefix string
+	// URL is the public URL the site is served at
+	URL string
+	// Keep is how many releases are kept, including the live one
+	Keep int
+	// Preserve lists the prefixes under the root that aren't part of the
+	// site, such as another site published in the same bucket
+	Preserve []string
+}
+
+// pointer is the content of the pointer object
+type pointer struct {
+	Release   string    `json:"release"`
+	Activated time.Time `json:"activated"`
+}
+
+// ReleaseKey returns the key of a file in a release
+func ReleaseKey(release, file string) string {
+	return ReleasesPrefix + release + "/" + file
+}
+
+// isLiveFile reports whether a file at the root of a target belongs to the
+// live release, rather than to the stored releases, the pointer or one of
+// the preserved prefixes
+func isLiveFile(file string, preserve []string) bool {
+	if strings.HasPrefix(file, ReleasesPrefix) || file == pointerKey {
+		return false
+	}
+	for _, prefix := range preserve {
+		if prefix != "" && strings.HasPrefix(file, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// activate copies a release to the root of a target with syncRoot. If that
+// fails partway, the previous live release is copied back, so the root
+// isn't left serving a mix of the two.
+func activate(release, previous string, syncRoot func(release string) (*SyncPlan, error)) (*SyncPlan, error) {
+	plan, err := syncRoot(release)
+	if err == nil || previous == "" || previous == release {
+		return plan, err
+	}
+	if _, restoreErr := syncRoot(previous); restoreErr != nil {
+		return nil, fmt.Errorf("failed to activate release %s, %v, or to restore release %s, %v", release, err, previous, restoreErr)
+	}
+	log.Printf("Restored release %s after failing to activate release %s", previous, release)
+	return nil, fmt.Errorf("failed to activate release %s, %v", release, err)
+}
+
+// pagesLast orders the files a release copies to the root so that pages
+// come after the files they reference
+func pagesLast(files []string) []string {
+	result := append([]string(nil), files...)
+	sort.SliceStable(result, func(i, j int) bool {
+		return !isPage(result[i]) && isPage(result[j])
+	})
+	return result
+}
+
+// isPage reports whether a site file is an HTML page
+func isPage(file string) bool {
+	return strings.HasSuffix(file, ".html")
+}
+
+// rebaseExtensions are the types of site files that can contain its absolute URLs
+var rebaseExtensions = map[string]bool{
+	".html": true,
+	".xml":  true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".txt":  true,
+}
+
+// RebaseSite rewrites the absolute URLs of a generated site built for the
+// root URL from, so it can be served at the root URL to instead
+func RebaseSite(dir, from, to string) error {
+	from, to = strings.TrimSuffix(from, "/")+"/", strings.TrimSuffix(to, "/")+"/"
+	if from == to {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || !rebaseExtensions[filepath.Ext(path)] {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rebased := bytes.ReplaceAll(buf, []byte(from), []byte(to))
+		if bytes.Equal(rebased, buf) {
+			return nil
+		}
+		return ioutil.WriteFile(path, rebased, info.Mode().Perm())
+	})
+}
+
+// Promote publishes a release of one target to another and makes it live there.
+// The release's files are copied without rebuilding the site, with only
+// their URLs rewritten for the other target.
+func Promote(from, to Target, release string) (*SyncReport, error) {
+	dir, err := ioutil.TempDir("", "gallery-promote-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := from.Export(release, dir); err != nil {
+		return nil, fmt.Errorf("failed to export release %s, %v", release, err)
+	}
+	if err := RebaseSite(dir, from.RootURL(), to.RootURL()); err != nil {
+		return nil, err
+	}
+	report, err := to.Publish(dir, release)
+	if err != nil {
+		return report, err
+	}
+	if err := to.Activate(release); err != nil {
+		return report, err
+	}
+	if pruned, err := to.Prune(); err != nil {
+		log.Printf("Unable to prune releases: %s", err)
+	} else if len(pruned) > 0 {
+		log.Printf("Pruned releases %v", pruned)
+	}
+	return report, nil
+}
+
+// key returns the key of a file of the site
+func (s *Site) key(file string) string {
+	return s.Prefix + file
+}
+
+// RootURL returns the URL the live release is served at
+func (s *Site) RootURL() string {
+	return strings.TrimSuffix(s.URL, "/") + "/"
+}
+
+// Publish uploads the generated site in dir as a new release. Files that
+// haven't changed since the live release are copied within the bucket
+// rather than uploaded again.
+func (s *Site) Publish(dir, release string) (*SyncReport, error) {
+	local, err := HashTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	sess := session.Must(session.NewSession())
+	svc := s3.New(sess)
+
+	previous := map[string]string{}
+	current, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	if current != "" {
+		etags, err := S3ListETags(svc, s.Bucket, s.key(ReleaseKey(current, "")))
+		if err != nil {
+			return nil, err
+		}
+		for key, etag := range etags {
+			previous[strings.TrimPrefix(key, s.key(ReleaseKey(current, "")))] = etag
+		}
+	}
+
+	plan := PlanSync(local, previous)
+	report := &SyncReport{Unchanged: plan.Unchanged, Deleted: plan.Delete}
+	uploader := s3manager.NewUploader(sess)
+	for _, file := range plan.Upload {
+		if err := uploadSiteFile(uploader, filepath.Join(dir, filepath.FromSlash(file)), s.Bucket, s.key(ReleaseKey(release, file))); err != nil {
+			return report, fmt.Errorf("failed to upload %q, %v", file, err)
+		}
+		report.Uploaded = append(report.Uploaded, file)
+	}
+	for file := range local {
+		if sum, ok := previous[file]; !ok || sum != local[file] {
+			continue
+		}
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(s.Bucket),
+			Key:        aws.String(s.key(ReleaseKey(release, file))),
+			CopySource: aws.String(url.PathEscape(s.Bucket + "/" + s.key(ReleaseKey(current, file)))),
+			ACL:        aws.String("public-read"),
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to copy %q, %v", file, err)
+		}
+	}
+	log.Printf("Published release %s to s3://%s/%s: %d uploaded, %d deleted, %d unchanged", release, s.Bucket, s.Prefix, len(report.Uploaded), len(report.Deleted), report.Unchanged)
+	return report, nil
+}
+
+// Export downloads the files of a release to dir
+func (s *Site) Export(release, dir string) error {
+	sess := session.Must(session.NewSession())
+	prefix := s.key(ReleaseKey(release, ""))
+	keys, err := S3ListETags(s3.New(sess), s.Bucket, prefix)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("release %s not found", release)
+	}
+	downloader := s3manager.NewDownloader(sess)
+	for key := range keys {
+		path := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(key, prefix)))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		_, err = downloader.Download(f, &s3.GetObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(key),
+		})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download %q, %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Current returns the live release, or an empty string if nothing has been published
+func (s *Site) Current() (string, error) {
+	svc := s3.New(session.New())
+	result, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(pointerKey)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return "", nil
+		}
+		return "", err
+	}
+	defer result.Body.Close()
+	buf, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return "", err
+	}
+	p := &pointer{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return "", err
+	}
+	return p.Release, nil
+}
+
+// Activate makes a release live by copying its files to the root of the
+// site within the bucket and removing the files it doesn't have, then
+// flipping the site's pointer to it. Only the files that differ from the
+// live release are copied. If that fails partway, the live release is
+// copied back.
+func (s *Site) Activate(release string) error {
+	previous, err := s.Current()
+	if err != nil {
+		return err
+	}
+	plan, err := activate(release, previous, s.syncRoot)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(&pointer{Release: release, Activated: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = S3UploadFile(&s3manager.UploadInput{
+		Body:         bytes.NewReader(buf),
+		Bucket:       aws.String(s.Bucket),
+		Key:          aws.String(s.key(pointerKey)),
+		ContentType:  aws.String("application/json"),
+		CacheControl: aws.String("no-cache"),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Release %s is live: %d files copied, %d deleted, %d unchanged", release, len(plan.Upload), len(plan.Delete), plan.Unchanged)
+	return nil
+}
+
+// syncRoot copies the files of a release that differ from the root of the
+// site to it, pages last, and then removes the files the release doesn't have
+func (s *Site) syncRoot(release string) (*SyncPlan, error) {
+	svc := s3.New(session.New())
+	prefix := s.key(ReleaseKey(release, ""))
+	stored, err := S3ListETags(svc, s.Bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("release %s not found", release)
+	}
+	files := map[string]string{}
+	for key, etag := range stored {
+		files[strings.TrimPrefix(key, prefix)] = etag
+	}
+	root, err := S3ListETags(svc, s.Bucket, s.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]string{}
+	for key, etag := range root {
+		if file := strings.TrimPrefix(key, s.Prefix); isLiveFile(file, s.Preserve) {
+			live[file] = etag
+		}
+	}
+
+	plan := PlanSync(files, live)
+	for _, file := range pagesLast(plan.Upload) {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(s.Bucket),
+			Key:        aws.String(s.key(file)),
+			CopySource: aws.String(url.PathEscape(s.Bucket + "/" + s.key(ReleaseKey(release, file)))),
+			ACL:        aws.String("public-read"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %q, %v", file, err)
+		}
+	}
+	for _, file := range plan.Delete {
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.key(file)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete %q, %v", file, err)
+		}
+	}
+	return plan, nil
+}
+
+// Releases returns the releases in the bucket, oldest first.
+// Release IDs are build IDs, which sort by creation time.
+func (s *Site) Releases() ([]string, error) {
+	svc := s3.New(session.New())
+	var releases []string
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(s.key(ReleasesPrefix)),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			releases = append(releases, strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, s.key(ReleasesPrefix)), "/"))
+		}
+		return true
+	})
+	sort.Strings(releases)
+	return releases, err
+}
+
+// HasRelease reports whether a release exists in the bucket
+func (s *Site) HasRelease(release string) (bool, error) {
+	svc := s3.New(session.New())
+	result, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.Bucket),
+		Prefix:  aws.String(s.key(ReleaseKey(release, ""))),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(result.Contents) > 0, nil
+}
+
+// Prune deletes all but the newest Keep releases. The live release is
+// always kept. It returns the deleted releases.
+func (s *Site) Prune() ([]string, error) {
+	current, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	releases, err := s.Releases()
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(session.New())
+	var pruned []string
+	for _, release := range PruneCandidates(releases, current, s.Keep) {
+		keys, err := S3ListETags(svc, s.Bucket, s.key(ReleaseKey(release, "")))
+		if err != nil {
+			return pruned, err
+		}
+		for key := range keys {
+			_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, release)
+	}
+	return pruned, nil
+}
+
+// PruneCandidates returns the releases to delete to keep the newest keep
+// releases, never including the live one. releases must be oldest first.
+func PruneCandidates(releases []string, current string, keep int) []string {
+	if keep < 1 {
+		keep = 1
+	}
+	var result []string
+	for i, release := range releases {
+		if len(releases)-i <= keep {
+			break
+		}
+		if release != current {
+			result = append(result, release)
+		}
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPruneCandidates(t *testing.T) {
+	releases := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		current string
+		keep    int
+		want    []string
+	}{
+		{"e", 3, []string{"a", "b"}},
+		{"e", 5, nil},
+		{"e", 10, nil},
+		{"a", 3, []string{"b"}},
+		{"e", 0, []string{"a", "b", "c", "d"}},
+		{"", 1, []string{"a", "b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		got := PruneCandidates(releases, tt.current, tt.keep)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PruneCandidates(%v, %q, %d) = %v, want %v", releases, tt.current, tt.keep, got, tt.want)
+		}
+	}
+}
+
+func TestRootURL(t *testing.T) {
+	for _, url := range []string{"https://photos.example.com", "https://photos.example.com/"} {
+		s := &Site{URL: url}
+		if got, want := s.RootURL(), "https://photos.example.com/"; got != want {
+			t.Errorf("RootURL() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestIsLiveFile(t *testing.T) {
+	preserve := []string{"preview/"}
+	tests := map[string]bool{
+		"index.html":                    true,
+		"css/main.css":                  true,
+		"releases/abc/index.html":       false,
+		"current.json":                  false,
+		"preview/index.html":            false,
+		"preview/releases/a/index.html": false,
+	}
+	for file, want := range tests {
+		if got := isLiveFile(file, preserve); got != want {
+			t.Errorf("isLiveFile(%q) = %v, want %v", file, got, want)
+		}
+	}
+	if got := pagesLast([]string{"index.html", "css/main.css", "page/index.html", "img/a.png"}); !reflect.DeepEqual(got, []string{"css/main.css", "img/a.png", "index.html", "page/index.html"}) {
+		t.Errorf("pagesLast() = %v", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// SyncReport describes what a release changed compared to the previous one
+type SyncReport struct {
+	Uploaded  []string `json:"uploaded"`
+	Deleted   []string `json:"deleted"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// SyncPlan lists the keys a sync uploads and deletes
+type SyncPlan struct {
+	Upload    []string
+	Delete    []string
+	Unchanged int
+}
+
+// PlanSync compares the content hashes of local files with the ETags of the
+// objects in the bucket. Both maps are keyed by object key.
+// Objects uploaded in multiple parts don't have an MD5 ETag, so they're
+// always uploaded again.
+func PlanSync(local, remote map[string]string) *SyncPlan {
+	plan := &SyncPlan{}
+	for key, sum := range local {
+		if etag, ok := remote[key]; ok && etag == sum {
+			plan.Unchanged++
+			continue
+		}
+		plan.Upload = append(plan.Upload, key)
+	}
+	for key := range remote {
+		if _, ok := local[key]; !ok {
+			plan.Delete = append(plan.Delete, key)
+		}
+	}
+	sort.Strings(plan.Upload)
+	sort.Strings(plan.Delete)
+	return plan
+}
+
+// HashTree returns the hex encoded MD5 of every file under dir,
+// keyed by its slash separated path relative to dir
+func HashTree(dir string) (map[string]string, error) {
+	return hashTree(dir, nil)
+}
+
+// hashTree is HashTree for only the files and directories keep reports true for
+func hashTree(dir string, keep func(rel string) bool) (map[string]string, error) {
+	result := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if keep != nil && rel != "." && !keep(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		result[rel] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return result, err
+}
+
+// S3ListETags returns the ETag of every object under a prefix, keyed by object key
+func S3ListETags(svc *s3.S3, bucket, prefix string) (map[string]string, error) {
+	result := map[string]string{}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			result[*o.Key] = strings.Trim(aws.StringValue(o.ETag), `"`)
+		}
+		return true
+	})
+	return result, err
+}
+
+// ContentType returns the Content-Type a site file is served with
+func ContentType(path string) string {
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// uploadSiteFile uploads a single file of the generated site
+func uploadSiteFile(uploader *s3manager.Uploader, path, bucket, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Body:        f,
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ACL:         aws.String("public-read"),
+		ContentType: aws.String(ContentType(path)),
+	})
+	return err
+}
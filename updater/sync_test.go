@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanSync(t *testing.T) {
+
+	local := map[string]string{
+		"index.html":        "aaa",
+		"css/gallery.css":   "bbb",
+		"tags/bears/index":  "ccc",
+		"img/multipart.jpg": "ddd",
+	}
+	remote := map[string]string{
+		"index.html":        "old",
+		"css/gallery.css":   "bbb",
+		"img/multipart.jpg": "ddd-2",
+		"post/removed":      "eee",
+	}
+
+	plan := PlanSync(local, remote)
+	if expected := []string{"img/multipart.jpg", "index.html", "tags/bears/index"}; !reflect.DeepEqual(plan.Upload, expected) {
+		t.Errorf("unexpected uploads: got %v want %v", plan.Upload, expected)
+	}
+	if expected := []string{"post/removed"}; !reflect.DeepEqual(plan.Delete, expected) {
+		t.Errorf("unexpected deletes: got %v want %v", plan.Delete, expected)
+	}
+	if plan.Unchanged != 1 {
+		t.Errorf("got %d unchanged files, want 1", plan.Unchanged)
+	}
+}
+
+func TestHashTree(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "public-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "css"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "css", "site.css"), []byte(""), 0644)
+
+	sums, err := HashTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"index.html":   "5d41402abc4b2a76b9719d911017c592",
+		"css/site.css": "d41d8cd98f00b204e9800998ecf8427e",
+	}
+	if !reflect.DeepEqual(sums, expected) {
+		t.Errorf("unexpected hashes: got %v want %v", sums, expected)
+	}
+
+	if ct := ContentType(filepath.Join(dir, "css", "site.css")); ct != "text/css; charset=utf-8" {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+}
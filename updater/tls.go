@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSFiles are the PEM files the updater serves TLS with
+type TLSFiles struct {
+	Cert string
+	Key  string
+	// ClientCA verifies client certificates. Clients don't need a
+	// certificate when it's empty.
+	ClientCA string
+}
+
+// tlsState is a loaded certificate and client CA pool
+type tlsState struct {
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// certCheckInterval is the least time between checks of the TLS files for
+// changes, so handshakes don't each stat them
+const certCheckInterval = time.Second
+
+// CertReloader serves the certificate and client CA in a set of TLS files,
+// picking up rotated files on a later handshake without a restart. If the
+// rotated files don't load, the server keeps its previous certificate, so a
+// half-written rotation doesn't break it.
+type CertReloader struct {
+	files TLSFiles
+
+	mu sync.Mutex
+	// version is the sizes and modification times of the loaded files
+	version string
+	state   *tlsState
+	// checked is when the files were last checked for changes
+	checked time.Time
+}
+
+// NewCertReloader loads a set of TLS files
+func NewCertReloader(files TLSFiles) (*CertReloader, error) {
+	if files.Cert == "" || files.Key == "" {
+		return nil, errors.New("a certificate and key are required")
+	}
+	c := &CertReloader{files: files}
+	version, err := c.filesVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(version); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ServerConfig returns a TLS config that serves the current certificate
+// and, if there's a client CA, requires clients to present a certificate
+// it signed
+func (c *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s := c.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+			}
+			if s.pool != nil {
+				config.ClientCAs = s.pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// current returns the loaded certificate and pool, reloading them first
+// if the files have changed since they were last checked
+func (c *CertReloader) current() *tlsState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.state
+	}
+	c.checked = time.Now()
+	version, err := c.filesVersion()
+	if err != nil {
+		log.Printf("Unable to check TLS files, keeping the loaded ones: %s", err)
+		return c.state
+	}
+	if version != c.version {
+		if err := c.load(version); err != nil {
+			log.Printf("Unable to reload TLS files, keeping the loaded ones: %s", err)
+		} else {
+			log.Printf("Reloaded TLS files")
+		}
+	}
+	return c.state
+}
+
+// load reads the files, which are at version. Must be called with c.mu held
+// or before c is shared.
+func (c *CertReloader) load(version string) error {
+	cert, err := tls.LoadX509KeyPair(c.files.Cert, c.files.Key)
+	if err != nil {
+		return err
+	}
+	state := &tlsState{cert: &cert}
+	if c.files.ClientCA != "" {
+		buf, err := ioutil.ReadFile(c.files.ClientCA)
+		if err != nil {
+			return err
+		}
+		state.pool = x509.NewCertPool()
+		if !state.pool.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificates in %s", c.files.ClientCA)
+		}
+	}
+	c.state, c.version = state, version
+	return nil
+}
+
+// filesVersion identifies the current contents of the certificate, key and
+// client CA files
+func (c *CertReloader) filesVersion() (string, error) {
+	var version []string
+	for _, path := range []string{c.files.Cert, c.files.Key, c.files.ClientCA} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		version = append(version, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(version, ","), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and its key
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate for name, signed by parent or self-signed if it's nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestFile writes a file with a modification time that changes on every write
+func writeTestFile(t *testing.T, path string, data []byte, modified time.Time) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloaderMutualTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "updater", ca)
+	client := newTestCert(t, "uploader", ca)
+	files := TLSFiles{
+		Cert:     filepath.Join(dir, "cert.pem"),
+		Key:      filepath.Join(dir, "key.pem"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+	}
+	modified := time.Now().Add(-time.Minute)
+	writeTestFile(t, files.Cert, server.certPEM, modified)
+	writeTestFile(t, files.Key, server.keyPEM, modified)
+	writeTestFile(t, files.ClientCA, ca.certPEM, modified)
+
+	certs, err := NewCertReloader(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	get := func(cert *testCert) (*http.Response, error) {
+		config := &tls.Config{RootCAs: pool}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		return c.Get("https://" + ln.Addr().String())
+	}
+
+	resp, err := get(client)
+	if err != nil {
+		t.Fatalf("client with a certificate was rejected: %s", err)
+	}
+	resp.Body.Close()
+	if _, err := get(nil); err == nil {
+		t.Errorf("client without a certificate was accepted")
+	}
+	if _, err := get(newTestCert(t, "intruder", nil)); err == nil {
+		t.Errorf("client with an untrusted certificate was accepted")
+	}
+
+	// A rotated certificate is served without a restart
+	rotated := newTestCert(t, "rotated", ca)
+	loaded := certs.current()
+	writeTestFile(t, files.Cert, rotated.certPEM, modified.Add(time.Second))
+	writeTestFile(t, files.Key, rotated.keyPEM, modified.Add(time.Second))
+	if certs.current() != loaded {
+		t.Errorf("files were checked again within %s", certCheckInterval)
+	}
+	certs.checked = time.Time{}
+	resp, err = get(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if name := resp.TLS.PeerCertificates[0].Subject.CommonName; name != "rotated" {
+		t.Errorf("served certificate %s after rotation, want rotated", name)
+	}
+
+	// A broken rotation keeps the loaded certificate
+	writeTestFile(t, files.Key, []byte("garbage"), modified.Add(2*time.Second))
+	certs.checked = time.Time{}
+	resp, err = get(client)
+	if err != nil {
+		t.Fatalf("broken rotation stopped the server: %s", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	// Image formats whose dimensions are read
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// LocalPhotos is a directory of photos and videos the gallery is built from
+// instead of the photo bucket, for self-hosting and local development.
+// A photo's caption is read from a text file next to it with the same name
+// and a .txt extension ("beach.jpg.txt" or "beach.txt"), or else from its
+// Exif description.
+type LocalPhotos struct {
+	Dir string
+	// Files is where the photos are copied to, to be served with the site
+	Files string
+}
+
+// localPhotos is the directory builds read photos from. Builds read the
+// photo bucket when it's nil.
+var localPhotos *LocalPhotos
+
+// localHeaderSize is how much of a photo is read for its Exif metadata and dimensions
+const localHeaderSize = 256 << 10
+
+// key returns the key of a file, given its path relative to Dir
+func (p *LocalPhotos) key(rel string) string {
+	return "photos/" + filepath.ToSlash(rel)
+}
+
+// path returns the path of the file with a key, or an empty string if
+// the key doesn't name a visible file within Dir
+func (p *LocalPhotos) path(key string) string {
+	rel := strings.TrimPrefix(key, "photos/")
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return ""
+		}
+	}
+	return filepath.Join(p.Dir, filepath.FromSlash(rel))
+}
+
+// captionFile returns the caption file of a photo, or an empty string if it has none
+func captionFile(path string) string {
+	for _, candidate := range []string{path + ".txt", strings.TrimSuffix(path, filepath.Ext(path)) + ".txt"} {
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// isMedia reports whether a file is a photo or video shown in the gallery
+func isMedia(path string) bool {
+	if strings.EqualFold(filepath.Ext(path), ".txt") {
+		return false
+	}
+	t := mediaType(ContentType(path))
+	return strings.HasPrefix(t, "image/") || strings.HasPrefix(t, "video/")
+}
+
+// Scan returns the version of each photo and video in the directory, by
+// key. A version covers the file and its caption file, so editing either
+// changes it. Hidden files and directories are skipped.
+func (p *LocalPhotos) Scan() (map[string]string, error) {
+	versions := map[string]string{}
+	err := filepath.Walk(p.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != p.Dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isMedia(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(p.Dir, path)
+		if err != nil {
+			return err
+		}
+		version := fmt.Sprintf("%d@%d", info.Size(), info.ModTime().UnixNano())
+		if caption := captionFile(path); caption != "" {
+			if c, err := os.Stat(caption); err == nil {
+				version += fmt.Sprintf("+%d@%d", c.Size(), c.ModTime().UnixNano())
+			}
+		}
+		versions[p.key(rel)] = version
+		return nil
+	})
+	return versions, err
+}
+
+// Entry returns the gallery entry for a photo, or nil if it doesn't exist
+func (p *LocalPhotos) Entry(key string) (*Entry, error) {
+	path := p.path(key)
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || !isMedia(path) {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, localHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+
+	e := &Entry{
+		Key:         key,
+		Kind:        MediaKindImage,
+		ContentType: ContentType(path),
+		Size:        info.Size(),
+		Taken:       info.ModTime(),
+		Uploaded:    info.ModTime(),
+	}
+	if strings.HasPrefix(e.ContentType, "video/") {
+		e.Kind = MediaKindVideo
+	} else if config, _, err := image.DecodeConfig(bytes.NewReader(header)); err == nil {
+		e.Width, e.Height = config.Width, config.Height
+	}
+	if exif, err := ReadExif(header); err == nil {
+		e.Caption = exif.Description
+		if !exif.Taken.IsZero() {
+			e.Taken = exif.Taken
+		}
+	}
+	if caption := captionFile(path); caption != "" {
+		buf, err := ioutil.ReadFile(caption)
+		if err != nil {
+			return nil, err
+		}
+		e.Caption = strings.TrimSpace(string(buf))
+	}
+	// There's no uploader to file local photos, so they're filed under their
+	// first hashtag
+	e.Album = DefaultAlbum
+	if tags := HashTags(e.Caption); len(tags) > 0 {
+		e.Album = tags[0]
+	}
+	return e, nil
+}
+
+// Entries returns the gallery entries for every photo in the directory
+func (p *LocalPhotos) Entries() ([]*Entry, error) {
+	versions, err := p.Scan()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []*Entry{}
+	for _, key := range keys {
+		e, err := p.Entry(key)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// Mirror copies the photos to Files, skipping the ones already copied, and
+// removes the copies of photos that are gone. It returns how many were copied.
+func (p *LocalPhotos) Mirror() (int, error) {
+	versions, err := p.Scan()
+	if err != nil {
+		return 0, err
+	}
+	var copied int
+	for key := range versions {
+		src := p.path(key)
+		dst := filepath.Join(p.Files, filepath.FromSlash(key))
+		info, err := os.Stat(src)
+		if err != nil {
+			return copied, err
+		}
+		if existing, err := os.Stat(dst); err == nil && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return copied, err
+		}
+		// Copy next to the destination and rename, so the file is never served half-written
+		tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+		if err := copyFile(src, tmp, 0644); err != nil {
+			os.Remove(tmp)
+			return copied, err
+		}
+		if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+			os.Remove(tmp)
+			return copied, err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+
+	root := filepath.Join(p.Files, "photos")
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(p.Files, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := versions[filepath.ToSlash(rel)]; !ok {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	return copied, err
+}
+
+// loadLocalPhotos returns the entries of the photos in a directory, reading
+// only the changed ones when the index is filled, and copies the photos to
+// where they're served
+func loadLocalPhotos(p *LocalPhotos, changes *Changes) ([]*Entry, error) {
+	if !changes.Full && photoIndex.Ready() {
+		if err := photoIndex.Apply(changes, p.Entry); err != nil {
+			return nil, err
+		}
+	} else {
+		entries, err := p.Entries()
+		if err != nil {
+			return nil, err
+		}
+		photoIndex.Replace(entries)
+	}
+	copied, err := p.Mirror()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Copied %d photos to %s", copied, p.Files)
+	return photoIndex.Entries(), nil
+}
+
+// Watcher finds the changes to a directory of photos from file system
+// notifications, or by comparing scans of it when they aren't available
+type Watcher struct {
+	photos *LocalPhotos
+	// Settle is how long notifications are collected before their changes
+	// are triggered, so copying many photos triggers few builds
+	Settle time.Duration
+	// versions are the versions of the photos found by the last scan
+	versions map[string]string
+	// dirs are the directories notifications are received for
+	dirs map[string]bool
+	// media are the keys of the photos notifications were received for.
+	// A removed file can't be sniffed, so they tell which removals were photos.
+	media map[string]bool
+}
+
+// NewWatcher creates a Watcher for a directory of photos
+func NewWatcher(photos *LocalPhotos) *Watcher {
+	return &Watcher{photos: photos, Settle: 500 * time.Millisecond}
+}
+
+// Poll returns the changes since the last poll. The first poll requests a
+// full build. A renamed photo is removed under its old key and added under
+// its new one.
+func (w *Watcher) Poll() (*Changes, error) {
+	versions, err := w.photos.Scan()
+	if err != nil {
+		return nil, err
+	}
+	previous := w.versions
+	w.versions = versions
+	if previous == nil {
+		return &Changes{Full: true}, nil
+	}
+
+	ops := map[string]string{}
+	removed := map[string]string{}
+	for key, version := range previous {
+		if _, ok := versions[key]; !ok {
+			apply(ops, changeDeleted, []string{key})
+			removed[version] = key
+		}
+	}
+	for key, version := range versions {
+		old, ok := previous[key]
+		switch {
+		case !ok:
+			apply(ops, changeAdded, []string{key})
+			if from, ok := removed[version]; ok {
+				log.Printf("%s was renamed to %s", from, key)
+			}
+		case old != version:
+			apply(ops, changeModified, []string{key})
+		}
+	}
+	changes := &Changes{}
+	changes.set(ops)
+	return changes, nil
+}
+
+// Watch triggers a build for each change to a directory of photos until ctx
+// is done, starting with a full build. Changes are found from file system
+// notifications; when those aren't available, the directory is scanned every
+// interval instead.
+func Watch(ctx context.Context, w *Watcher, interval time.Duration, trigger func(source string, changes *Changes) string) {
+	err := w.Notify(ctx, trigger)
+	if err == nil {
+		return
+	}
+	log.Printf("Unable to watch %s for changes, scanning it every %s instead: %s", w.photos.Dir, interval, err)
+	for ctx.Err() == nil {
+		changes, err := w.Poll()
+		if err != nil {
+			log.Printf("Unable to scan %s: %s", w.photos.Dir, err)
+		} else if !changes.Empty() {
+			queue(trigger, changes)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
+
+// queue triggers a build for changes found in the directory
+func queue(trigger func(source string, changes *Changes) string, changes *Changes) {
+	id := trigger("watch", changes)
+	log.Printf("Queued build %s for %d added, %d modified and %d deleted photos",
+		id, len(changes.Added), len(changes.Modified), len(changes.Deleted))
+}
+
+// Notify triggers builds for the changes to a directory of photos reported
+// by file system notifications until ctx is done, starting with a full
+// build. It fails if notifications can't be received for the directory.
+// A full build is triggered when notifications are lost, or when a whole
+// directory is removed, since the photos that were in it aren't known.
+func (w *Watcher) Notify(ctx context.Context, trigger func(source string, changes *Changes) string) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+	w.dirs, w.media = map[string]bool{}, map[string]bool{}
+	if _, err := w.addDirs(fw, w.photos.Dir); err != nil {
+		return err
+	}
+	queue(trigger, &Changes{Full: true})
+
+	ops := map[string]string{}
+	var full bool
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Notifications for %s were lost: %s", w.photos.Dir, err)
+			full = true
+		case e, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			if !w.event(fw, e, ops) {
+				full = true
+			}
+		case <-settled:
+			settled = nil
+			changes := &Changes{Full: full}
+			changes.set(ops)
+			ops, full = map[string]string{}, false
+			if !changes.Empty() {
+				queue(trigger, changes)
+			}
+			continue
+		}
+		if settled == nil {
+			settled = time.After(w.Settle)
+		}
+	}
+}
+
+// addDirs receives notifications for dir and the visible directories in it,
+// and returns the keys of the photos in them
+func (w *Watcher) addDirs(fw *fsnotify.Watcher, dir string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != w.photos.Dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := fw.Add(path); err != nil {
+				return err
+			}
+			w.dirs[path] = true
+			return nil
+		}
+		if rel, err := filepath.Rel(w.photos.Dir, path); err == nil && info.Mode().IsRegular() && isMedia(path) {
+			key := w.photos.key(rel)
+			keys = append(keys, key)
+			w.media[key] = true
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// event records the change a notification reports in ops. It returns false
+// when the change can't be described by keys and needs a full build.
+func (w *Watcher) event(fw *fsnotify.Watcher, e fsnotify.Event, ops map[string]string) bool {
+	rel, err := filepath.Rel(w.photos.Dir, e.Name)
+	if err != nil || w.photos.path(w.photos.key(rel)) == "" {
+		// Hidden files aren't part of the gallery
+		return true
+	}
+	key := w.photos.key(rel)
+	gone := e.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+	if gone && w.dirs[e.Name] {
+		delete(w.dirs, e.Name)
+		for k := range w.media {
+			if strings.HasPrefix(k, key+"/") {
+				delete(w.media, k)
+			}
+		}
+		return false
+	}
+	if gone && w.media[key] {
+		delete(w.media, key)
+		apply(ops, changeDeleted, []string{key})
+		return true
+	}
+	if e.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+			// Photos may have been added before the directory was watched
+			keys, err := w.addDirs(fw, e.Name)
+			if err != nil {
+				log.Printf("Unable to watch %s: %s", e.Name, err)
+				return false
+			}
+			apply(ops, changeAdded, keys)
+			return true
+		}
+	}
+
+	if !gone && e.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+		return true
+	}
+	if strings.EqualFold(filepath.Ext(e.Name), ".txt") {
+		// A caption file changes the caption of its photo
+		for _, photo := range captionedPhotos(e.Name) {
+			if rel, err := filepath.Rel(w.photos.Dir, photo); err == nil {
+				apply(ops, changeModified, []string{w.photos.key(rel)})
+			}
+		}
+		return true
+	}
+	if gone {
+		// Only removing a known photo changes the gallery
+		return true
+	}
+	op := changeModified
+	if e.Op&fsnotify.Create != 0 {
+		op = changeAdded
+	}
+	if isMedia(e.Name) {
+		w.media[key] = true
+		apply(ops, op, []string{key})
+	}
+	return true
+}
+
+// captionedPhotos returns the photos a caption file may belong to
+func captionedPhotos(caption string) []string {
+	photo := strings.TrimSuffix(caption, filepath.Ext(caption))
+	if isMedia(photo) {
+		return []string{photo}
+	}
+	matches, _ := filepath.Glob(escapeGlob(photo) + ".*")
+	var result []string
+	for _, m := range matches {
+		if isMedia(m) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// escapeGlob escapes the special characters of a glob pattern
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
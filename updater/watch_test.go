@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLocalPhotos(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	photos := &LocalPhotos{Dir: filepath.Join(dir, "photos"), Files: filepath.Join(dir, "site", "files")}
+	write := func(name string, data []byte) {
+		path := filepath.Join(photos.Dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("beach.jpg", testJPEG(t, 40, 30, "Sunset #Beach", "2020:07:04 19:30:00"))
+	write("trip/hike.jpg", testJPEG(t, 30, 40, "Exif caption", "2020:07:05 09:00:00"))
+	write("trip/hike.txt", []byte("Summit! #Trip\n"))
+	write("notes.txt", []byte("not a photo"))
+	write(".hidden.jpg", testJPEG(t, 1, 1, "", ""))
+
+	w := NewWatcher(photos)
+	if changes, err := w.Poll(); err != nil || !changes.Full {
+		t.Fatalf("first poll isn't a full build: %+v, %v", changes, err)
+	}
+	entries, err := loadLocalPhotos(photos, &Changes{Full: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	beach, hike := entries[0], entries[1]
+	if beach.Key != "photos/beach.jpg" || beach.Caption != "Sunset #Beach" || beach.Album != "beach" ||
+		beach.Width != 40 || beach.Height != 30 || beach.Taken.Day() != 4 {
+		t.Errorf("unexpected entry %+v", beach)
+	}
+	if hike.Key != "photos/trip/hike.jpg" || hike.Caption != "Summit! #Trip" {
+		t.Errorf("sidecar caption wasn't used: %+v", hike)
+	}
+	if _, err := os.Stat(filepath.Join(photos.Files, "photos", "trip", "hike.jpg")); err != nil {
+		t.Errorf("photo wasn't copied: %s", err)
+	}
+	for _, key := range []string{"photos/../secret.jpg", "photos/.hidden.jpg", "photos/notes.txt"} {
+		if e, err := photos.Entry(key); e != nil || err != nil {
+			t.Errorf("%s has an entry: %+v, %v", key, e, err)
+		}
+	}
+
+	// Rename a photo, edit a caption and add a photo
+	if err := os.Rename(filepath.Join(photos.Dir, "beach.jpg"), filepath.Join(photos.Dir, "sunset.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	write("trip/hike.txt", []byte("Summit reached #Trip"))
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filepath.Join(photos.Dir, "trip", "hike.txt"), later, later)
+	write("trip/lake.jpg", testJPEG(t, 10, 10, "", ""))
+
+	changes, err := w.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Changes{
+		Added:    []string{"photos/sunset.jpg", "photos/trip/lake.jpg"},
+		Modified: []string{"photos/trip/hike.jpg"},
+		Deleted:  []string{"photos/beach.jpg"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes: got %+v want %+v", changes, expected)
+	}
+	if changes, _ := w.Poll(); !changes.Empty() {
+		t.Errorf("unchanged directory has changes %+v", changes)
+	}
+
+	entries, err = loadLocalPhotos(photos, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var captions []string
+	for _, e := range entries {
+		captions = append(captions, e.Caption)
+	}
+	if expected := []string{"Sunset #Beach", "Summit reached #Trip", ""}; !reflect.DeepEqual(captions, expected) {
+		t.Errorf("unexpected captions: got %q want %q", captions, expected)
+	}
+	if _, err := os.Stat(filepath.Join(photos.Files, "photos", "beach.jpg")); !os.IsNotExist(err) {
+		t.Errorf("copy of a renamed photo wasn't removed: %v", err)
+	}
+}
+
+func TestWatcherNotify(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	photos := &LocalPhotos{Dir: dir}
+	if err := ioutil.WriteFile(filepath.Join(dir, "beach.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	triggered := make(chan *Changes, 10)
+	trigger := func(source string, changes *Changes) string {
+		triggered <- changes
+		return "build"
+	}
+	w := NewWatcher(photos)
+	w.Settle = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- w.Notify(ctx, trigger) }()
+
+	next := func() *Changes {
+		select {
+		case changes := <-triggered:
+			return changes
+		case err := <-done:
+			t.Fatalf("Notify() = %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no build was triggered")
+		}
+		return nil
+	}
+	if changes := next(); !changes.Full {
+		t.Fatalf("first build isn't full: %+v", changes)
+	}
+
+	// A new album, a caption and a removed photo are collected into one build
+	if err := os.Mkdir(filepath.Join(dir, "trip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "trip", "hike.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "beach.txt"), []byte("Sunset"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".hidden.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes := next()
+	for len(changes.Added) == 0 || len(changes.Modified) == 0 {
+		// Notifications may straddle the settle delay
+		more := next()
+		changes.Added = append(changes.Added, more.Added...)
+		changes.Modified = append(changes.Modified, more.Modified...)
+	}
+	if changes.Full || !reflect.DeepEqual(changes.Added, []string{"photos/trip/hike.jpg"}) ||
+		!reflect.DeepEqual(changes.Modified, []string{"photos/beach.jpg"}) {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "beach.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if changes := next(); !reflect.DeepEqual(changes.Deleted, []string{"photos/beach.jpg"}) {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+
+	// Removing an album needs a full build
+	if err := os.RemoveAll(filepath.Join(dir, "trip")); err != nil {
+		t.Fatal(err)
+	}
+	if changes := next(); !changes.Full {
+		t.Errorf("removing an album isn't a full build: %+v", changes)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Notify() = %v", err)
+	}
+}
+
+func TestWatcherNotifyDeletesFilesWithoutExtensions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	if err := ioutil.WriteFile(filepath.Join(dir, "scan"), jpeg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	triggered := make(chan *Changes, 10)
+	w := NewWatcher(&LocalPhotos{Dir: dir})
+	w.Settle = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Notify(ctx, func(source string, changes *Changes) string {
+		triggered <- changes
+		return "build"
+	})
+	next := func() *Changes {
+		select {
+		case changes := <-triggered:
+			return changes
+		case <-time.After(5 * time.Second):
+			t.Fatal("no build was triggered")
+		}
+		return nil
+	}
+	next()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "later"), jpeg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changes := next(); !reflect.DeepEqual(changes.Added, []string{"photos/later"}) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	for _, name := range []string{"scan", "later"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := next()
+	for len(changes.Deleted) < 2 {
+		changes.Deleted = append(changes.Deleted, next().Deleted...)
+	}
+	sort.Strings(changes.Deleted)
+	if want := []string{"photos/later", "photos/scan"}; !reflect.DeepEqual(changes.Deleted, want) {
+		t.Errorf("Deleted = %v, want %v", changes.Deleted, want)
+	}
+}
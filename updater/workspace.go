@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// siteDirs lists the directories of a Hugo site that are copied into a workspace.
+// Generated output and anything else in the site directory (like the updater
+// binary itself) is left out.
+var siteDirs = map[string]bool{
+	"archetypes": true,
+	"assets":     true,
+	"content":    true,
+	"data":       true,
+	"i18n":       true,
+	"layouts":    true,
+	"static":     true,
+	"themes":     true,
+}
+
+// NewWorkspace copies the Hugo site in siteDir to a new temporary directory
+// and returns its path. The caller removes it when the build is done.
+func NewWorkspace(siteDir string) (string, error) {
+	dir, err := ioutil.TempDir("", "gallery-build-")
+	if err != nil {
+		return "", err
+	}
+	if err := copyTree(siteDir, dir, inSite); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// copyTree copies the files under src to dst. If keep isn't nil, only the
+// paths it accepts are copied.
+func copyTree(src, dst string, keep func(rel string, info os.FileInfo) bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if keep != nil && !keep(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// copyFile copies a regular file
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// inSite reports whether a path relative to the site directory is part of the site
+func inSite(rel string, info os.FileInfo) bool {
+	if rel == "." {
+		return true
+	}
+	top := strings.Split(filepath.ToSlash(rel), "/")[0]
+	if top != rel {
+		return siteDirs[top]
+	}
+	if info.IsDir() {
+		return siteDirs[top]
+	}
+	return strings.HasPrefix(top, "config.")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewWorkspace(t *testing.T) {
+
+	site, err := ioutil.TempDir("", "site-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(site)
+	files := map[string]string{
+		"config.toml":                   `title = "Photos"`,
+		"content/_index.md":             "####",
+		"layouts/shortcodes/video.html": "<video>",
+		"public/index.html":             "stale",
+		"api":                           "binary",
+	}
+	for name, content := range files {
+		path := filepath.Join(site, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := NewWorkspace(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"config.toml", "content/_index.md", "layouts/shortcodes/video.html"} {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(buf) != files[name] {
+			t.Errorf("%s wasn't copied: %v", name, err)
+		}
+	}
+	for _, name := range []string{"public/index.html", "api"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was copied into the workspace", name)
+		}
+	}
+}
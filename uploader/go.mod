@@ -9,4 +9,5 @@ require (
 	github.com/rs/xid v1.2.1
 	github.com/sgryczan/scanley v0.0.0-20200803140325-62029f50e678
 	github.com/stretchr/testify v1.5.1 // indirect
+	golang.org/x/image v0.18.0
 )
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+// CatalogEnabled records published objects in the catalog journal,
+// which the updater builds the gallery from
+var CatalogEnabled bool
+
+// recordCatalog adds a published object to the catalog journal. sender and
+// message are only known at ingest and are empty for later changes.
+// Failures are only logged, since the object's metadata still describes it.
+func recordCatalog(key, contentType string, size int64, metadata map[string]*string, sender, message string) {
+	if !CatalogEnabled {
+		return
+	}
+	r := utils.NewCatalogRecord(key, contentType, size, metadata)
+	r.Sender, r.Message = sender, message
+	if err := utils.S3PutCatalogRecord(DestinationBucket, r); err != nil {
+		log.Printf("Unable to record %s in the catalog: %s", key, err.Error())
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+// CollageEnabled composes a collage of the photos in multi-photo messages
+var CollageEnabled bool
+
+// CollageCellSize is the size, in pixels, of each photo in a collage
+var CollageCellSize = 600
+
+// mediaKindCollage is the kind of collage objects
+const mediaKindCollage = "collage"
+
+// composeCollage returns a collage of the photos in a message,
+// or nil if the message has fewer than two photos
+func composeCollage(media []*mediaFile, album string) (*mediaFile, error) {
+	var images []image.Image
+	var photos []string
+	for _, m := range media {
+		if m.Image != nil && len(images) < utils.MaxCollageImages {
+			images = append(images, m.Image)
+			photos = append(photos, m.Key)
+		}
+	}
+	if len(images) < 2 {
+		return nil, nil
+	}
+
+	body, err := renderCollage(images, album)
+	if err != nil {
+		return nil, err
+	}
+	return &mediaFile{
+		Key:         fmt.Sprintf("collages/%s", utils.ContentHash(body)),
+		Body:        body,
+		ContentType: "image/jpeg",
+		Kind:        mediaKindCollage,
+		Photos:      photos,
+	}, nil
+}
+
+// renderCollage returns the public rendition of a collage of images
+func renderCollage(images []image.Image, album string) ([]byte, error) {
+	img := utils.Collage(images, CollageCellSize)
+	body, err := utils.EncodeImage(img, "image/jpeg")
+	if err != nil {
+		return nil, err
+	}
+	return renderPublic(img, body, "image/jpeg", album)
+}
+
+// refreshCollages recomposes collages from the current renditions of their
+// photos, after some of them were transformed or rerendered. The collages
+// keep their keys, so the photos that link to them don't change. Failures
+// are only logged, since the photos themselves were updated.
+func refreshCollages(keys []string) {
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if err := refreshCollage(key); err != nil {
+			log.Printf("Unable to refresh collage %s: %s", key, err.Error())
+		}
+	}
+}
+
+// refreshCollage recomposes a collage from the originals of its photos with
+// their transforms applied
+func refreshCollage(key string) error {
+	head, err := utils.S3HeadObject(DestinationBucket, key)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return fmt.Errorf("%s doesn't exist", key)
+	}
+	photos := strings.Split(aws.StringValue(head.Metadata["Photos"]), ",")
+	if len(photos) < 2 {
+		return errors.New("the collage doesn't record its photos")
+	}
+
+	var images []image.Image
+	for _, photo := range photos {
+		published, err := utils.S3HeadObject(DestinationBucket, publicKey(photo))
+		if err != nil || published == nil {
+			log.Printf("%s isn't published, leaving it out of %s", photo, key)
+			continue
+		}
+		img, err := transformedOriginal(photo, published.Metadata)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+	}
+	if len(images) < 2 {
+		return errors.New("fewer than two of its photos are published")
+	}
+
+	album := aws.StringValue(head.Metadata["Album"])
+	if album == "" {
+		album = utils.DefaultAlbum
+	}
+	body, err := renderCollage(images, album)
+	if err != nil {
+		return err
+	}
+	err = utils.S3UploadFile(&s3manager.UploadInput{
+		Body:        utils.BytesToReader(body),
+		Bucket:      aws.String(DestinationBucket),
+		Key:         aws.String(key),
+		ACL:         aws.String("public-read"),
+		ContentType: aws.String("image/jpeg"),
+		Metadata:    head.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Refreshed collage %s", key)
+	recordCatalog(key, "image/jpeg", int64(len(body)), head.Metadata, "", "")
+	return nil
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sgryczan/photoGallery/uploader/models"
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+// handleCommand runs the SMS command in a message without media.
+// It returns the reply to send, and false if the message isn't a command.
+func handleCommand(inboundMMS *models.InboundMMS) (string, bool) {
+	if inboundMMS.NumMedia > 0 {
+		return "", false
+	}
+	fields := strings.Fields(strings.ToUpper(inboundMMS.Body))
+	if len(fields) == 0 {
+		return "", false
+	}
+	switch fields[0] {
+	case "KEEP":
+		return keepPending(inboundMMS.From), true
+	case "ROTATE", "CROP", "UNDO":
+		return transformLastUpload(inboundMMS.From, fields), true
+	}
+	return "", false
+}
+
+// lastUpload records the photos in a sender's most recent message
+type lastUpload struct {
+	Keys []string
+	Sent time.Time
+}
+
+// lastUploadKey returns where the last upload of a sender is recorded
+func lastUploadKey(sender string) string {
+	return fmt.Sprintf("senders/%s/last.json", strings.TrimPrefix(sender, "+"))
+}
+
+// saveLastUpload records the photos a sender just uploaded,
+// so later commands can refer to them
+func saveLastUpload(sender string, keys []string) error {
+	buf, err := json.Marshal(&lastUpload{Keys: keys, Sent: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return utils.S3UploadFile(&s3manager.UploadInput{
+		Body:        utils.BytesToReader(buf),
+		Bucket:      aws.String(DestinationBucket),
+		Key:         aws.String(lastUploadKey(sender)),
+		ACL:         aws.String("private"),
+		ContentType: aws.String("application/json"),
+	})
+}
+
+// parseTransform returns the transform requested by a ROTATE or CROP command,
+// and the number of the photo it applies to (0 for all of them)
+func parseTransform(fields []string) (string, int, error) {
+	usage := errors.New("try ROTATE 90, ROTATE 180, ROTATE 270, CROP SQUARE or UNDO, optionally followed by the photo number")
+	var transform string
+	var args []string
+	switch {
+	case fields[0] == "UNDO":
+		args = fields[1:]
+	case len(fields) >= 2 && fields[0] == "ROTATE":
+		switch fields[1] {
+		case "90", "RIGHT":
+			transform = utils.TransformRotate90
+		case "180":
+			transform = utils.TransformRotate180
+		case "270", "-90", "LEFT":
+			transform = utils.TransformRotate270
+		default:
+			return "", 0, usage
+		}
+		args = fields[2:]
+	case len(fields) >= 2 && fields[0] == "CROP" && fields[1] == "SQUARE":
+		transform = utils.TransformCropSquare
+		args = fields[2:]
+	default:
+		return "", 0, usage
+	}
+	if len(args) == 0 {
+		return transform, 0, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || len(args) > 1 {
+		return "", 0, usage
+	}
+	return transform, n, nil
+}
+
+// transformLastUpload applies a ROTATE, CROP or UNDO command to the photos
+// in a sender's last message. Transforms are recorded in the photo's metadata
+// and the rendition is regenerated from the original, so they can be undone.
+func transformLastUpload(sender string, fields []string) string {
+	transform, n, err := parseTransform(fields)
+	if err != nil {
+		return fmt.Sprintf("Sorry, I didn't understand that: %s.", err.Error())
+	}
+
+	buf, err := utils.S3GetObject(DestinationBucket, lastUploadKey(sender))
+	last := &lastUpload{}
+	if err == nil {
+		err = json.Unmarshal(buf, last)
+	}
+	if err != nil || len(last.Keys) == 0 {
+		log.Printf("No last upload for %s: %v", sender, err)
+		return "You haven't uploaded any photos yet."
+	}
+	keys := last.Keys
+	if n > 0 {
+		if n > len(keys) {
+			return fmt.Sprintf("Your last message only had %d photos.", len(keys))
+		}
+		keys = keys[n-1 : n]
+	}
+
+	var changed, collages []string
+	for _, key := range keys {
+		head, err := utils.S3HeadObject(DestinationBucket, key)
+		if err != nil || head == nil {
+			log.Printf("Unable to read %s: %v", key, err)
+			continue
+		}
+		metadata := head.Metadata
+		if metadata == nil {
+			metadata = map[string]*string{}
+		}
+		transforms := utils.ParseTransforms(aws.StringValue(metadata["Transform"]))
+		if transform == "" {
+			if len(transforms) == 0 {
+				continue
+			}
+			transforms = transforms[:len(transforms)-1]
+		} else {
+			transforms = append(transforms, transform)
+		}
+		metadata["Transform"] = aws.String(utils.FormatTransforms(transforms))
+
+		album := aws.StringValue(metadata["Album"])
+		if album == "" {
+			album = utils.DefaultAlbum
+		}
+		if err := rerender(key, album, aws.StringValue(head.ContentType), metadata); err != nil {
+			log.Printf("Unable to transform %s: %s", key, err.Error())
+			continue
+		}
+		log.Printf("Applied %q to %s", utils.FormatTransforms(transforms), key)
+		changed = append(changed, key)
+		collages = append(collages, aws.StringValue(metadata["Collage"]))
+	}
+	if len(changed) == 0 {
+		if transform == "" {
+			return "There's nothing to undo."
+		}
+		return "Sorry, your photo couldn't be changed. Please try again."
+	}
+
+	refreshCollages(collages)
+	go utils.InvokeUpdate(GalleryUpdateURL, &utils.Update{Modified: changed})
+	if transform == "" {
+		return "Undone!"
+	}
+	return "Done! Reply UNDO to change it back."
+}
+
+// pendingKey returns where a photo is held while it awaits confirmation
+func pendingKey(sender, key string) string {
+	return fmt.Sprintf("pending/%s/%s", strings.TrimPrefix(sender, "+"), strings.TrimPrefix(key, "photos/"))
+}
+
+// publishVoiceCaptions makes the voice memos held with a photo public
+func publishVoiceCaptions(metadata map[string]*string) {
+	for _, key := range strings.Split(aws.StringValue(metadata["Voice-Caption"]), ",") {
+		if key == "" {
+			continue
+		}
+		head, err := utils.S3HeadObject(DestinationBucket, key)
+		if err != nil || head == nil {
+			log.Printf("Unable to read %s: %v", key, err)
+			continue
+		}
+		if err := utils.S3UpdateMetadata(DestinationBucket, key, head, head.Metadata); err != nil {
+			log.Print(err.Error())
+		}
+	}
+}
+
+// keepPending publishes the photos a sender has confirmed
+func keepPending(sender string) string {
+	keys, err := utils.S3ListKeys(DestinationBucket, pendingKey(sender, ""))
+	if err != nil {
+		log.Print(err.Error())
+		return "Sorry, something went wrong. Please try again."
+	}
+	if len(keys) == 0 {
+		return "You don't have any photos waiting to be published."
+	}
+
+	var published []string
+	for _, key := range keys {
+		head, err := utils.S3HeadObject(DestinationBucket, key)
+		if err != nil || head == nil {
+			log.Printf("Unable to read %s: %v", key, err)
+			continue
+		}
+		metadata := head.Metadata
+		target := aws.StringValue(metadata["Target"])
+		if target == "" {
+			log.Printf("%s has no target key", key)
+			continue
+		}
+		delete(metadata, "Target")
+		if err := utils.S3MoveObject(DestinationBucket, key, target, "public-read", metadata); err != nil {
+			log.Print(err.Error())
+			continue
+		}
+		log.Printf("Published %s as %s", key, target)
+		publishVoiceCaptions(metadata)
+		recordCatalog(target, aws.StringValue(head.ContentType), aws.Int64Value(head.ContentLength), metadata, "", "")
+		published = append(published, target)
+	}
+	if len(published) == 0 {
+		return "Sorry, your photos couldn't be published. Please try again."
+	}
+	if err := saveLastUpload(sender, published); err != nil {
+		log.Printf("Unable to record last upload: %s", err.Error())
+	}
+
+	go utils.InvokeUpdate(GalleryUpdateURL, &utils.Update{Added: published})
+	if len(published) == 1 {
+		return "Photo published!"
+	}
+	return fmt.Sprintf("%d photos published!", len(published))
+}
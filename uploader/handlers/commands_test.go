@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sgryczan/photoGallery/uploader/models"
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+func TestHandleCommandIgnoresMessages(t *testing.T) {
+
+	messages := []*models.InboundMMS{
+		{Body: "Look at this bear", NumMedia: 1},
+		{Body: "KEEP", NumMedia: 1},
+		{Body: "Hello there"},
+		{Body: "   "},
+	}
+	for _, m := range messages {
+		if _, ok := handleCommand(m); ok {
+			t.Errorf("%q with %d media was handled as a command", m.Body, m.NumMedia)
+		}
+	}
+}
+
+func TestPendingKey(t *testing.T) {
+
+	got := pendingKey("+17205550100", "photos/abc123")
+	expected := "pending/17205550100/abc123"
+	if got != expected {
+		t.Errorf("unexpected pending key: got %v want %v", got, expected)
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+
+	commands := map[string]struct {
+		transform string
+		photo     int
+	}{
+		"ROTATE 90":     {utils.TransformRotate90, 0},
+		"ROTATE LEFT 2": {utils.TransformRotate270, 2},
+		"ROTATE 180":    {utils.TransformRotate180, 0},
+		"CROP SQUARE 1": {utils.TransformCropSquare, 1},
+		"UNDO":          {"", 0},
+		"UNDO 3":        {"", 3},
+	}
+	for command, expected := range commands {
+		transform, photo, err := parseTransform(strings.Fields(command))
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", command, err)
+			continue
+		}
+		if transform != expected.transform || photo != expected.photo {
+			t.Errorf("%q: got %q photo %d, want %q photo %d", command, transform, photo, expected.transform, expected.photo)
+		}
+	}
+
+	for _, command := range []string{"ROTATE", "ROTATE 45", "CROP", "CROP CIRCLE", "ROTATE 90 0", "UNDO ALL"} {
+		if _, _, err := parseTransform(strings.Fields(command)); err == nil {
+			t.Errorf("%q was accepted", command)
+		}
+	}
+}
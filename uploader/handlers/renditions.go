@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+// OriginalsBucket holds the unmodified originals of published photos.
+// It must not be public. When it's empty, originals are kept privately
+// in the DestinationBucket.
+var OriginalsBucket string
+
+// Watermarks holds the per-album watermark settings
+var Watermarks utils.WatermarkConfig
+
+// originalsBucket returns the bucket originals are stored in
+func originalsBucket() string {
+	if OriginalsBucket != "" {
+		return OriginalsBucket
+	}
+	return DestinationBucket
+}
+
+// originalKey returns the key of the original of a photo
+func originalKey(key string) string {
+	return "originals/" + photoID(key)
+}
+
+// publicKey returns the key of the published rendition of a photo
+func publicKey(key string) string {
+	return "photos/" + photoID(key)
+}
+
+// photoID returns the content hash a photo's keys are derived from
+func photoID(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, "photos/"), "originals/")
+}
+
+// saveOriginal stores the original of a photo privately
+func saveOriginal(key string, body []byte, contentType string, metadata map[string]*string) error {
+	return utils.S3UploadFile(&s3manager.UploadInput{
+		Body:        utils.BytesToReader(body),
+		Bucket:      aws.String(originalsBucket()),
+		Key:         aws.String(originalKey(key)),
+		ACL:         aws.String("private"),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	})
+}
+
+// renderPublic returns the public rendition of a photo in an album.
+// Photos are re-encoded even when the album has no watermark, so only
+// their pixels are published. Animated GIFs are never watermarked, since
+// the watermark would only be drawn on their first frame.
+func renderPublic(img image.Image, body []byte, contentType, album string) ([]byte, error) {
+	wm := Watermarks.For(album)
+	if wm == nil || contentType == "image/gif" {
+		return utils.CleanImage(img, body, contentType)
+	}
+	return utils.EncodeImage(wm.Apply(img), contentType)
+}
+
+// transformedOriginal returns the original of a photo with the transforms
+// recorded in its metadata applied
+func transformedOriginal(key string, metadata map[string]*string) (image.Image, error) {
+	body, err := utils.S3GetObject(originalsBucket(), originalKey(key))
+	if err != nil {
+		return nil, err
+	}
+	img, err := utils.DecodeImage(body)
+	if err != nil {
+		return nil, fmt.Errorf("original can't be decoded: %s", err)
+	}
+	return utils.ApplyTransforms(img, utils.ParseTransforms(aws.StringValue(metadata["Transform"])))
+}
+
+// rerender replaces a published photo with a new rendition of its original,
+// applying the transforms recorded in its metadata. The photo's dimensions
+// and perceptual hash are updated to match the rendition.
+func rerender(key, album, contentType string, metadata map[string]*string) error {
+	body, err := utils.S3GetObject(originalsBucket(), originalKey(key))
+	if err != nil {
+		return err
+	}
+	img, err := utils.DecodeImage(body)
+	if err != nil {
+		return fmt.Errorf("original can't be decoded: %s", err)
+	}
+	if transforms := utils.ParseTransforms(aws.StringValue(metadata["Transform"])); len(transforms) > 0 {
+		img, err = utils.ApplyTransforms(img, transforms)
+		if err != nil {
+			return err
+		}
+		if body, err = utils.EncodeImage(img, contentType); err != nil {
+			return err
+		}
+	}
+	metadata["Width"] = aws.String(strconv.Itoa(img.Bounds().Dx()))
+	metadata["Height"] = aws.String(strconv.Itoa(img.Bounds().Dy()))
+	metadata["Phash"] = aws.String(utils.FormatHash(utils.DifferenceHash(img)))
+
+	rendition, err := renderPublic(img, body, contentType, album)
+	if err != nil {
+		return err
+	}
+	err = utils.S3UploadFile(&s3manager.UploadInput{
+		Body:        utils.BytesToReader(rendition),
+		Bucket:      aws.String(DestinationBucket),
+		Key:         aws.String(publicKey(key)),
+		ACL:         aws.String("public-read"),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return err
+	}
+	recordCatalog(publicKey(key), contentType, int64(len(rendition)), metadata, "", "")
+	return nil
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+// Reprocess regenerates the public renditions of an album's photos from
+// their originals, e.g. after its watermark settings change.
+// All albums are reprocessed when album is empty.
+func Reprocess(album string) error {
+	keys, err := utils.S3ListKeys(originalsBucket(), "originals/")
+	if err != nil {
+		return err
+	}
+
+	var reprocessed, collages []string
+	for _, key := range keys {
+		original, err := utils.S3HeadObject(originalsBucket(), key)
+		if err != nil || original == nil {
+			log.Printf("Unable to read %s: %v", key, err)
+			continue
+		}
+		a := aws.StringValue(original.Metadata["Album"])
+		if a == "" {
+			a = utils.DefaultAlbum
+		}
+		if album != "" && a != album {
+			continue
+		}
+
+		// The published photo's metadata may have changed since upload
+		// (aliases, confirmations), so keep it rather than the original's
+		published, err := utils.S3HeadObject(DestinationBucket, publicKey(key))
+		if err != nil || published == nil {
+			log.Printf("%s isn't published, skipping", key)
+			continue
+		}
+
+		if err := rerender(key, a, aws.StringValue(published.ContentType), published.Metadata); err != nil {
+			log.Printf("Unable to reprocess %s: %s", key, err.Error())
+			continue
+		}
+		log.Printf("Reprocessed %s", publicKey(key))
+		reprocessed = append(reprocessed, publicKey(key))
+		collages = append(collages, aws.StringValue(published.Metadata["Collage"]))
+	}
+	refreshCollages(collages)
+
+	log.Printf("Reprocessed %d photos", len(reprocessed))
+	if len(reprocessed) > 0 {
+		return utils.InvokeUpdate(GalleryUpdateURL, &utils.Update{Modified: reprocessed})
+	}
+	return nil
+}
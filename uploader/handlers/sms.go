@@ -3,12 +3,17 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"image"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sgryczan/photoGallery/uploader/models"
 	"github.com/sgryczan/photoGallery/uploader/utils"
@@ -20,6 +25,37 @@ var S3AccessKey string
 var S3SecretKeyID string
 var AllowedSenders []string
 
+// MinSharpness is the sharpness score below which photos are held
+// until the sender confirms them. Zero disables the check.
+var MinSharpness float64
+
+// MinBrightness is the mean brightness below which photos are held
+// until the sender confirms them. Zero disables the check.
+var MinBrightness float64
+
+// MaxDark is the fraction of nearly black pixels above which photos are
+// held until the sender confirms them. Zero disables the check.
+var MaxDark float64
+
+// DuplicateCaptionAliases adds the caption of a duplicate photo
+// to the original as an alias instead of discarding it
+var DuplicateCaptionAliases bool
+
+// mediaFile is a media attachment downloaded from Twilio
+type mediaFile struct {
+	Key         string
+	Body        []byte
+	ContentType string
+	Kind        string
+	PHash       string
+	Quality     *utils.Quality
+	Width       int
+	Height      int
+	Image       image.Image
+	// Photos are the keys of the photos a collage is composed of
+	Photos []string
+}
+
 // SMSHandler accepts inbound MMS messages and copies media to S3
 func SMSHandler(w http.ResponseWriter, r *http.Request) {
 	// swagger:operation POST /sms SMS sms
@@ -111,6 +147,13 @@ func SMSHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Is the message a command?
+	if reply, ok := handleCommand(inboundMMS); ok {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%s", twimlResponse(reply))
+		return
+	}
+
 	// Does the request contain media?
 	// Must return 200 for Twilio to relay the message back to the sender
 	if inboundMMS.NumMedia == 0 {
@@ -125,9 +168,12 @@ func SMSHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	received := time.Now().UTC()
+	media := make([]*mediaFile, 0, inboundMMS.NumMedia)
+	var rejected []string
 	for i := 0; i < inboundMMS.NumMedia; i++ {
 
-		log.Printf("Processing image %d/%d", i+1, inboundMMS.NumMedia)
+		log.Printf("Processing media %d/%d", i+1, inboundMMS.NumMedia)
 		// Copy image from source S3 bucket to destination S3 Bucket
 		key := fmt.Sprintf("MediaUrl%d", i)
 		mediaLocation, _ := utils.GetFileLocation(inboundMMS.MediaURLs[key])
@@ -145,25 +191,222 @@ func SMSHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// We need to set the Content-Type to make sure clients decode it as an image
-		contentType := http.DetectContentType(file)
+		// Only publish files that really are the media they claim to be.
+		// We need to set the Content-Type to make sure clients decode it correctly.
+		declared := inboundMMS.MediaContentTypes[fmt.Sprintf("MediaContentType%d", i)]
+		valid, err := utils.ValidateMedia(file, declared)
+		if err != nil {
+			log.Printf("Rejected media %d: %s", i+1, err.Error())
+			rejected = append(rejected, fmt.Sprintf("Sorry, attachment %d was rejected: %s.", i+1, err.Error()))
+			continue
+		}
+		log.Printf("Media Content-Type: %s", valid.ContentType)
+
+		m := &mediaFile{
+			Key:         fmt.Sprintf("photos/%s", utils.ContentHash(file)),
+			Body:        file,
+			ContentType: valid.ContentType,
+			Kind:        valid.Kind,
+			Width:       valid.Width,
+			Height:      valid.Height,
+		}
+		if valid.Image != nil {
+			m.Image = valid.Image
+			// The perceptual hash lets the updater group near-identical shots
+			m.PHash = utils.FormatHash(utils.DifferenceHash(valid.Image))
+			q := utils.MeasureQuality(valid.Image)
+			m.Quality = &q
+		}
+		// Voice memos aren't gallery entries, so keep them out of photos/
+		if m.Kind == utils.MediaKindAudio {
+			m.Key = fmt.Sprintf("audio/%s", utils.ContentHash(file))
+		}
+		media = append(media, m)
+	}
+
+	// Audio attachments become voice captions of the message's images
+	var voiceCaptions []string
+	var published []*mediaFile
+	for _, m := range media {
+		if m.Kind == utils.MediaKindAudio {
+			voiceCaptions = append(voiceCaptions, m.Key)
+			continue
+		}
+		published = append(published, m)
+	}
+
+	var uploaded int
+	var photos, added []string
+	replies := rejected
+	album := utils.AlbumOf(inboundMMS.Body)
+
+	// Duplicates are skipped before anything is uploaded, so only the files
+	// that are really new are composed into the collage and published
+	var fresh []*mediaFile
+	var duplicates []*s3.HeadObjectOutput
+	var duplicateKeys []string
+	for _, m := range media {
+		// Objects are keyed by content, so an existing key means the exact
+		// same file was sent before
+		existing, err := utils.S3HeadObject(DestinationBucket, m.Key)
+		if err != nil {
+			log.Print(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error reading from S3: %s", err.Error())
+			return
+		}
+		if existing == nil {
+			fresh = append(fresh, m)
+			continue
+		}
+		log.Printf("%s is a duplicate", m.Key)
+		if m.Kind == utils.MediaKindAudio {
+			continue
+		}
+		if m.Kind == utils.MediaKindImage {
+			duplicates = append(duplicates, existing)
+			duplicateKeys = append(duplicateKeys, m.Key)
+		}
+		reply := fmt.Sprintf("You already sent this photo on %s", sentOn(existing).Format("January 2, 2006"))
+		if DuplicateCaptionAliases {
+			added, err := addCaptionAlias(m.Key, existing, inboundMMS.Body)
+			if err != nil {
+				log.Print(err.Error())
+			}
+			if added {
+				reply += ", so your caption was added as an alias"
+			}
+		}
+		replies = append(replies, reply+".")
+	}
+
+	// Photos held for confirmation aren't published by this message
+	var public []*mediaFile
+	for _, m := range fresh {
+		if m.Kind == utils.MediaKindImage && qualityProblem(m.Quality) == "" {
+			public = append(public, m)
+		}
+	}
+	// Voice memos are attached to the photos this message adds, and are only
+	// public once one of them is. When all of the photos were sent before,
+	// the memos are attached to those instead, and when the message has no
+	// photos, the memos aren't kept.
+	var images []*mediaFile
+	for _, m := range fresh {
+		if m.Kind == utils.MediaKindImage {
+			images = append(images, m)
+		}
+	}
+	audioACL := "public-read"
+	var modified []string
+	switch {
+	case len(voiceCaptions) == 0 || len(public) > 0:
+		// Any memos are published with the new photos
+	case len(images) > 0:
+		audioACL = "private"
+		replies = append(replies, "Your voice memo will be published with the photo.")
+	case len(duplicates) > 0:
+		for i, existing := range duplicates {
+			if err := addVoiceCaptions(duplicateKeys[i], existing, voiceCaptions); err != nil {
+				log.Print(err.Error())
+				continue
+			}
+			modified = append(modified, duplicateKeys[i])
+		}
+		if len(modified) > 0 {
+			replies = append(replies, "Your voice memo was added to the photo you sent before.")
+		} else {
+			replies = append(replies, "Sorry, your voice memo couldn't be added to the photo you sent before.")
+		}
+	default:
+		fresh = withoutAudio(fresh)
+		replies = append(replies, "Sorry, your voice memo wasn't saved because there was no photo to attach it to.")
+	}
 
+	// Videos use the first photo published with them as their poster frame
+	var poster string
+	if len(public) > 0 {
+		poster = public[0].Key
+	}
+	// Compose the photos that are published right away into a collage for
+	// the gallery cover
+	var collage *mediaFile
+	if CollageEnabled {
+		collage, err = composeCollage(public, album)
+		if err != nil {
+			log.Printf("Unable to compose collage: %s", err.Error())
+		}
+	}
+	for _, m := range fresh {
 		var caption string
-		if inboundMMS.NumMedia > 1 {
-			caption = fmt.Sprintf("%s (%d/%d)", inboundMMS.Body, i+1, inboundMMS.NumMedia)
+		if i := indexOf(published, m); len(published) > 1 && i >= 0 {
+			caption = fmt.Sprintf("%s (%d/%d)", inboundMMS.Body, i+1, len(published))
 		} else {
 			caption = inboundMMS.Body
 		}
 
+		metadata := map[string]*string{
+			"caption": aws.String(caption),
+			"kind":    aws.String(m.Kind),
+			"taken":   aws.String(received.Format(time.RFC3339)),
+			"album":   aws.String(album),
+		}
+		if m.Width > 0 && m.Height > 0 {
+			metadata["width"] = aws.String(strconv.Itoa(m.Width))
+			metadata["height"] = aws.String(strconv.Itoa(m.Height))
+		}
+		if m.PHash != "" {
+			metadata["phash"] = aws.String(m.PHash)
+		}
+		if m.Quality != nil {
+			metadata["sharpness"] = aws.String(fmt.Sprintf("%.1f", m.Quality.Sharpness))
+			metadata["brightness"] = aws.String(fmt.Sprintf("%.1f", m.Quality.Brightness))
+			metadata["dark"] = aws.String(fmt.Sprintf("%.2f", m.Quality.Dark))
+		}
+
+		// Keep the original clean and publish a rendition of it
+		body := m.Body
+		if m.Kind == utils.MediaKindImage {
+			err = saveOriginal(m.Key, m.Body, m.ContentType, metadata)
+			if err == nil {
+				body, err = renderPublic(m.Image, m.Body, m.ContentType, album)
+			}
+			if err != nil {
+				log.Print(err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "Error creating rendition: %s", err.Error())
+				return
+			}
+		}
+
+		// Poor quality photos are held privately until the sender confirms them
+		key, acl := m.Key, "public-read"
+		if m.Kind == utils.MediaKindAudio {
+			acl = audioACL
+		}
+		if problem := qualityProblem(m.Quality); problem != "" {
+			log.Printf("%s looks %s, holding it for confirmation", m.Key, problem)
+			metadata["target"] = aws.String(m.Key)
+			key, acl = pendingKey(inboundMMS.From, m.Key), "private"
+			replies = append(replies, fmt.Sprintf("This photo looks %s — reply KEEP to publish anyway", problem))
+		}
+		if m.Kind == utils.MediaKindVideo && poster != "" {
+			metadata["poster"] = aws.String(poster)
+		}
+		if m.Kind == utils.MediaKindImage && len(voiceCaptions) > 0 {
+			metadata["voice-caption"] = aws.String(strings.Join(voiceCaptions, ","))
+		}
+		if m.Kind == utils.MediaKindImage && collage != nil && acl == "public-read" {
+			metadata["collage"] = aws.String(collage.Key)
+		}
+
 		uploadInput := &s3manager.UploadInput{
-			Body:        utils.BytesToReader(file),
+			Body:        utils.BytesToReader(body),
 			Bucket:      aws.String(DestinationBucket),
-			Key:         aws.String(fmt.Sprintf("photos/%s", mediaLocation.Key)),
-			ACL:         aws.String("public-read"),
-			ContentType: &contentType,
-			Metadata: map[string]*string{
-				"caption": &caption,
-			},
+			Key:         aws.String(key),
+			ACL:         aws.String(acl),
+			ContentType: aws.String(m.ContentType),
+			Metadata:    metadata,
 		}
 
 		err = utils.S3UploadFile(uploadInput)
@@ -173,22 +416,172 @@ func SMSHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "Error copying to S3: %s", err.Error())
 			return
 		}
+		if m.Kind != utils.MediaKindAudio && acl == "public-read" {
+			uploaded++
+			added = append(added, m.Key)
+			recordCatalog(m.Key, m.ContentType, int64(len(body)), metadata, inboundMMS.From, inboundMMS.MessageSid)
+		}
+		if m.Kind == utils.MediaKindImage && acl == "public-read" {
+			photos = append(photos, m.Key)
+		}
 	}
 
-	if inboundMMS.NumMedia == 1 {
-		resp = `<?xml version="1.0" encoding="UTF-8"?>
-			<Response>
-			<Message>Photo uploaded successfully!</Message>
-			</Response>`
-	} else {
-		resp = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
-			<Response>
-			<Message>%d photos uploaded successfully!</Message>
-			</Response>`, inboundMMS.NumMedia)
+	// Remember the photos so the sender can ROTATE or CROP them
+	if len(photos) > 0 {
+		if err := saveLastUpload(inboundMMS.From, photos); err != nil {
+			log.Printf("Unable to record last upload: %s", err.Error())
+		}
+	}
+
+	if collage != nil && uploaded > 0 {
+		metadata := map[string]*string{
+			"caption": aws.String(inboundMMS.Body),
+			"kind":    aws.String(collage.Kind),
+			"taken":   aws.String(received.Format(time.RFC3339)),
+			"album":   aws.String(album),
+			"photos":  aws.String(strings.Join(collage.Photos, ",")),
+		}
+		err = utils.S3UploadFile(&s3manager.UploadInput{
+			Body:        utils.BytesToReader(collage.Body),
+			Bucket:      aws.String(DestinationBucket),
+			Key:         aws.String(collage.Key),
+			ACL:         aws.String("public-read"),
+			ContentType: aws.String(collage.ContentType),
+			Metadata:    metadata,
+		})
+		if err != nil {
+			log.Printf("Unable to upload collage: %s", err.Error())
+		} else {
+			recordCatalog(collage.Key, collage.ContentType, int64(len(collage.Body)), metadata, inboundMMS.From, inboundMMS.MessageSid)
+		}
+	}
+
+	switch {
+	case len(media) == 0:
+	case uploaded == 1:
+		replies = append([]string{"Photo uploaded successfully!"}, replies...)
+	case uploaded > 1:
+		replies = append([]string{fmt.Sprintf("%d photos uploaded successfully!", uploaded)}, replies...)
+	}
+	resp = twimlResponse(replies...)
+	if uploaded == 0 && len(modified) == 0 {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%s", resp)
+		return
 	}
 
-	go utils.InvokeUpdate(GalleryUpdateURL)
+	go utils.InvokeUpdate(GalleryUpdateURL, &utils.Update{Added: added, Modified: modified, Message: inboundMMS.MessageSid})
 	w.WriteHeader(http.StatusOK)
 	//json, _ := json.MarshalIndent(resp, "", "  ")
 	fmt.Fprintf(w, "%s", resp)
 }
+
+// indexOf returns the position of m in media, or -1 if it isn't present
+func indexOf(media []*mediaFile, m *mediaFile) int {
+	for i, v := range media {
+		if v == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// sentOn returns when an existing object was first sent. Its last modified
+// time isn't used, because adding a caption alias rewrites the object.
+func sentOn(existing *s3.HeadObjectOutput) time.Time {
+	if taken := existing.Metadata["Taken"]; taken != nil {
+		if t, err := time.Parse(time.RFC3339, *taken); err == nil {
+			return t
+		}
+	}
+	return aws.TimeValue(existing.LastModified)
+}
+
+// withoutAudio returns media without its audio files
+func withoutAudio(media []*mediaFile) []*mediaFile {
+	var result []*mediaFile
+	for _, m := range media {
+		if m.Kind != utils.MediaKindAudio {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// addVoiceCaptions appends voice memos to the "voice-caption" metadata of
+// an existing photo
+func addVoiceCaptions(key string, existing *s3.HeadObjectOutput, captions []string) error {
+	metadata := existing.Metadata
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	var keys []string
+	if v := metadata["Voice-Caption"]; v != nil && *v != "" {
+		keys = strings.Split(*v, ",")
+	}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		seen[k] = true
+	}
+	for _, c := range captions {
+		if !seen[c] {
+			seen[c] = true
+			keys = append(keys, c)
+		}
+	}
+	metadata["Voice-Caption"] = aws.String(strings.Join(keys, ","))
+	if err := utils.S3UpdateMetadata(DestinationBucket, key, existing, metadata); err != nil {
+		return err
+	}
+	recordCatalog(key, aws.StringValue(existing.ContentType), aws.Int64Value(existing.ContentLength), metadata, "", "")
+	return nil
+}
+
+// addCaptionAlias appends caption to the "aliases" metadata of an existing object.
+// Aliases are separated by "|". It returns false if there was nothing to add.
+func addCaptionAlias(key string, existing *s3.HeadObjectOutput, caption string) (bool, error) {
+	caption = strings.TrimSpace(strings.ReplaceAll(caption, "|", " "))
+	if caption == "" {
+		return false, nil
+	}
+	metadata := existing.Metadata
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	var aliases []string
+	if a := metadata["Aliases"]; a != nil && *a != "" {
+		aliases = strings.Split(*a, "|")
+	}
+	if c := metadata["Caption"]; c != nil && *c == caption {
+		return false, nil
+	}
+	for _, a := range aliases {
+		if a == caption {
+			return false, nil
+		}
+	}
+	metadata["Aliases"] = aws.String(strings.Join(append(aliases, caption), "|"))
+	if err := utils.S3UpdateMetadata(DestinationBucket, key, existing, metadata); err != nil {
+		return false, err
+	}
+	recordCatalog(key, aws.StringValue(existing.ContentType), aws.Int64Value(existing.ContentLength), metadata, "", "")
+	return true, nil
+}
+
+// qualityProblem describes why a photo shouldn't be published without
+// confirmation, or returns an empty string if it looks fine
+func qualityProblem(q *utils.Quality) string {
+	if q == nil {
+		return ""
+	}
+	if MinSharpness > 0 && q.Sharpness < MinSharpness {
+		return "blurry"
+	}
+	if MinBrightness > 0 && q.Brightness < MinBrightness {
+		return "too dark"
+	}
+	if MaxDark > 0 && q.Dark > MaxDark {
+		return "too dark"
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/sgryczan/photoGallery/uploader/utils"
+)
+
+func TestQualityProblem(t *testing.T) {
+
+	defer func(sharpness, brightness, dark float64) {
+		MinSharpness, MinBrightness, MaxDark = sharpness, brightness, dark
+	}(MinSharpness, MinBrightness, MaxDark)
+	MinSharpness, MinBrightness, MaxDark = 100, 40, 0.8
+
+	tests := []struct {
+		quality *utils.Quality
+		want    string
+	}{
+		{nil, ""},
+		{&utils.Quality{Sharpness: 500, Brightness: 120, Dark: 0.1}, ""},
+		{&utils.Quality{Sharpness: 50, Brightness: 120, Dark: 0.1}, "blurry"},
+		{&utils.Quality{Sharpness: 500, Brightness: 20, Dark: 0.1}, "too dark"},
+		// A night shot with a bright moon is bright on average but mostly black
+		{&utils.Quality{Sharpness: 500, Brightness: 60, Dark: 0.9}, "too dark"},
+	}
+	for _, tt := range tests {
+		if got := qualityProblem(tt.quality); got != tt.want {
+			t.Errorf("qualityProblem(%+v) = %q, want %q", tt.quality, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+// twimlResponse builds a TwiML response that replies to the sender
+// with one SMS per message
+func twimlResponse(messages ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<Response>\n")
+	for _, m := range messages {
+		buf.WriteString("<Message>")
+		xml.EscapeText(&buf, []byte(m))
+		buf.WriteString("</Message>\n")
+	}
+	buf.WriteString("</Response>")
+	return buf.String()
+}
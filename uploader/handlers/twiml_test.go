@@ -0,0 +1,17 @@
+package handlers
+
+import "testing"
+
+func TestTwimlResponse(t *testing.T) {
+
+	got := twimlResponse("Photo uploaded successfully!", "You already sent <this> & that")
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+<Message>Photo uploaded successfully!</Message>
+<Message>You already sent &lt;this&gt; &amp; that</Message>
+</Response>`
+	if got != expected {
+		t.Errorf("unexpected response: got \n%v want \n%v", got, expected)
+	}
+}
@@ -12,10 +12,13 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/sgryczan/photoGallery/uploader/handlers"
+	"github.com/sgryczan/photoGallery/uploader/utils"
 )
 
 var (
 	listenPort = flag.Int("port", 8080, "Port to listen on")
+	reprocess  = flag.Bool("reprocess", false, "Regenerate public renditions from the originals and exit")
+	album      = flag.String("album", "", "Only reprocess this album")
 )
 
 // AWS_ACCESS_KEY_ID and
@@ -23,11 +26,21 @@ var (
 // AWS_REGION
 func main() {
 
+	flag.Parse()
+
 	handlers.DestinationBucket = os.Getenv("S3_BUCKET")
+	handlers.OriginalsBucket = os.Getenv("ORIGINALS_BUCKET")
 	handlers.GalleryUpdateURL = os.Getenv("UPDATE_API_URL")
 	awsRegion := os.Getenv("AWS_REGION")
 	allowedSenders := os.Getenv("ALLOWED_SENDERS")
 	handlers.AllowedSenders = strings.Split(allowedSenders, ",")
+	handlers.MinSharpness, _ = strconv.ParseFloat(os.Getenv("QUALITY_MIN_SHARPNESS"), 64)
+	handlers.MinBrightness, _ = strconv.ParseFloat(os.Getenv("QUALITY_MIN_BRIGHTNESS"), 64)
+	handlers.MaxDark, _ = strconv.ParseFloat(os.Getenv("QUALITY_MAX_DARK"), 64)
+	handlers.CollageEnabled, _ = strconv.ParseBool(os.Getenv("COLLAGE"))
+	handlers.DuplicateCaptionAliases, _ = strconv.ParseBool(os.Getenv("DUPLICATE_CAPTION_ALIASES"))
+	handlers.CatalogEnabled, _ = strconv.ParseBool(os.Getenv("CATALOG"))
+	utils.UpdateSecret = os.Getenv("UPDATE_SECRET")
 
 	if awsRegion == "" {
 		log.Printf("AWS_REGION not set. Defaulting to us-east-1")
@@ -39,6 +52,9 @@ func main() {
 	if handlers.GalleryUpdateURL == "" {
 		log.Fatalf("UPDATE_API_URL environment variable not set!")
 	}
+	if utils.UpdateSecret == "" {
+		log.Printf("UPDATE_SECRET not set. Update requests won't be signed")
+	}
 	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key == "" {
 		log.Fatalf("AWS_ACCESS_KEY_ID not set!")
 	}
@@ -46,6 +62,34 @@ func main() {
 		log.Fatalf("AWS_SECRET_ACCESS_KEY not set!")
 	}
 
+	tlsFiles := utils.TLSFiles{
+		Cert: os.Getenv("UPDATE_TLS_CERT_FILE"),
+		Key:  os.Getenv("UPDATE_TLS_KEY_FILE"),
+		CA:   os.Getenv("UPDATE_TLS_CA_FILE"),
+	}
+	if tlsFiles != (utils.TLSFiles{}) {
+		certs, err := utils.NewCertReloader(tlsFiles)
+		if err != nil {
+			log.Fatalf("Unable to load update TLS files: %s", err)
+		}
+		utils.UpdateTLS = certs
+	}
+
+	if config := os.Getenv("WATERMARK_CONFIG"); config != "" {
+		watermarks, err := utils.LoadWatermarkConfig(config)
+		if err != nil {
+			log.Fatalf("Unable to load WATERMARK_CONFIG: %s", err)
+		}
+		handlers.Watermarks = watermarks
+	}
+
+	if *reprocess {
+		if err := handlers.Reprocess(*album); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Grab Destination Bucket from Environment
 	// Grab AWS Credentials from Environment
 	r := mux.NewRouter()
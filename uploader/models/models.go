@@ -19,6 +19,7 @@ type InboundMMS struct {
 	AccountSid        string
 	From              string
 	MediaURLs         map[string]string
+	MediaContentTypes map[string]string
 	APIVersion        string
 }
 
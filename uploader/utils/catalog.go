@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// CatalogChangesPrefix is where the catalog journal is kept in the photo bucket.
+// Every change to a published photo adds a record under it, and the updater
+// replays the records it hasn't seen into its catalog.
+const CatalogChangesPrefix = "catalog/changes/"
+
+// catalogTimeFormat sorts lexically in time order
+const catalogTimeFormat = "20060102T150405.000000000Z"
+
+// CatalogRecord is everything known about a published photo, video or collage.
+// It holds fields that don't fit in S3 user metadata, like the sender.
+type CatalogRecord struct {
+	Key           string    `json:"key"`
+	Kind          string    `json:"kind"`
+	ContentType   string    `json:"content_type"`
+	Size          int64     `json:"size"`
+	Caption       string    `json:"caption"`
+	Aliases       []string  `json:"aliases,omitempty"`
+	Album         string    `json:"album"`
+	Width         int       `json:"width,omitempty"`
+	Height        int       `json:"height,omitempty"`
+	Taken         time.Time `json:"taken"`
+	PHash         string    `json:"phash,omitempty"`
+	Sharpness     float64   `json:"sharpness,omitempty"`
+	Brightness    float64   `json:"brightness,omitempty"`
+	Poster        string    `json:"poster,omitempty"`
+	VoiceCaptions []string  `json:"voice_captions,omitempty"`
+	Collage       string    `json:"collage,omitempty"`
+	Transforms    []string  `json:"transforms,omitempty"`
+	// Sender and Message are only known at ingest. Later changes leave
+	// them empty and the catalog keeps the recorded values.
+	Sender  string `json:"sender,omitempty"`
+	Message string `json:"message,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// Updated is when the change was made. Older changes never replace newer ones.
+	Updated time.Time `json:"updated"`
+}
+
+// NewCatalogRecord creates the record of an object from its metadata.
+// Metadata names are matched case insensitively, since S3 returns them canonicalized.
+func NewCatalogRecord(key, contentType string, size int64, metadata map[string]*string) *CatalogRecord {
+	meta := func(name string) string {
+		for k, v := range metadata {
+			if strings.EqualFold(k, name) {
+				return aws.StringValue(v)
+			}
+		}
+		return ""
+	}
+	split := func(s, sep string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, sep)
+	}
+	r := &CatalogRecord{
+		Key:           key,
+		Kind:          meta("kind"),
+		ContentType:   contentType,
+		Size:          size,
+		Caption:       meta("caption"),
+		Aliases:       split(meta("aliases"), "|"),
+		Album:         meta("album"),
+		PHash:         meta("phash"),
+		Poster:        meta("poster"),
+		VoiceCaptions: split(meta("voice-caption"), ","),
+		Collage:       meta("collage"),
+		Transforms:    ParseTransforms(meta("transform")),
+	}
+	if r.Kind == "" {
+		r.Kind = MediaKind(contentType)
+	}
+	if r.Album == "" {
+		r.Album = AlbumOf(r.Caption)
+	}
+	r.Width, _ = strconv.Atoi(meta("width"))
+	r.Height, _ = strconv.Atoi(meta("height"))
+	r.Sharpness, _ = strconv.ParseFloat(meta("sharpness"), 64)
+	r.Brightness, _ = strconv.ParseFloat(meta("brightness"), 64)
+	r.Taken, _ = time.Parse(time.RFC3339, meta("taken"))
+	return r
+}
+
+// CatalogChangeKey returns the journal key of a change to a record
+func CatalogChangeKey(r *CatalogRecord) string {
+	return fmt.Sprintf("%s%s-%s.json", CatalogChangesPrefix, r.Updated.UTC().Format(catalogTimeFormat), strings.ReplaceAll(r.Key, "/", "_"))
+}
+
+// S3PutCatalogRecord adds a change to the catalog journal in bucket
+func S3PutCatalogRecord(bucket string, r *CatalogRecord) error {
+	if r.Updated.IsZero() {
+		r.Updated = time.Now().UTC()
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return S3UploadFile(&s3manager.UploadInput{
+		Body:        BytesToReader(buf),
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(CatalogChangeKey(r)),
+		ACL:         aws.String("private"),
+		ContentType: aws.String("application/json"),
+	})
+}
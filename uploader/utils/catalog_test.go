@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestNewCatalogRecord(t *testing.T) {
+	// Metadata written by the uploader is lowercase, metadata read back from S3 is canonicalized
+	for _, canonical := range []bool{false, true} {
+		metadata := map[string]*string{
+			"caption":       aws.String("Hike #Trip (1/2)"),
+			"kind":          aws.String(MediaKindImage),
+			"taken":         aws.String("2021-05-01T12:00:00Z"),
+			"width":         aws.String("4032"),
+			"height":        aws.String("3024"),
+			"phash":         aws.String("00ff00ff00ff00ff"),
+			"sharpness":     aws.String("152.5"),
+			"aliases":       aws.String("first|second"),
+			"voice-caption": aws.String("audio/a,audio/b"),
+			"transform":     aws.String(TransformRotate90 + ";" + TransformCropSquare),
+		}
+		if canonical {
+			for k, v := range metadata {
+				delete(metadata, k)
+				metadata[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+		r := NewCatalogRecord("photos/abc", "image/jpeg", 1234, metadata)
+		want := &CatalogRecord{
+			Key:           "photos/abc",
+			Kind:          MediaKindImage,
+			ContentType:   "image/jpeg",
+			Size:          1234,
+			Caption:       "Hike #Trip (1/2)",
+			Aliases:       []string{"first", "second"},
+			Album:         "trip",
+			Width:         4032,
+			Height:        3024,
+			Taken:         time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC),
+			PHash:         "00ff00ff00ff00ff",
+			Sharpness:     152.5,
+			VoiceCaptions: []string{"audio/a", "audio/b"},
+			Transforms:    []string{TransformRotate90, TransformCropSquare},
+		}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("NewCatalogRecord() = %+v, want %+v", r, want)
+		}
+	}
+}
+
+func TestCatalogChangeKey(t *testing.T) {
+	r := &CatalogRecord{Key: "photos/abc", Updated: time.Date(2021, 5, 1, 12, 0, 0, 5, time.UTC)}
+	if got, want := CatalogChangeKey(r), "catalog/changes/20210501T120000.000000005Z-photos_abc.json"; got != want {
+		t.Errorf("CatalogChangeKey() = %q, want %q", got, want)
+	}
+	later := &CatalogRecord{Key: "photos/000", Updated: r.Updated.Add(time.Millisecond)}
+	if CatalogChangeKey(later) <= CatalogChangeKey(r) {
+		t.Errorf("change keys don't sort in time order")
+	}
+}
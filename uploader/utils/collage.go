@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// MaxCollageImages is the most photos a collage is composed of
+const MaxCollageImages = 9
+
+// collageGap is the space between photos in a collage, in pixels
+const collageGap = 8
+
+// CollageGrid returns the number of columns and rows used for n photos
+func CollageGrid(n int) (cols, rows int) {
+	cols = int(math.Ceil(math.Sqrt(float64(n))))
+	rows = (n + cols - 1) / cols
+	return cols, rows
+}
+
+// Collage composes photos into a grid of square cells of the given size.
+// Each photo is scaled to cover its cell and cropped around its center.
+// Only the first MaxCollageImages photos are used.
+func Collage(images []image.Image, cell int) image.Image {
+	if len(images) > MaxCollageImages {
+		images = images[:MaxCollageImages]
+	}
+	cols, rows := CollageGrid(len(images))
+	out := image.NewRGBA(image.Rect(0, 0, cols*cell+(cols+1)*collageGap, rows*cell+(rows+1)*collageGap))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, img := range images {
+		col, row := i%cols, i/cols
+		x := collageGap + col*(cell+collageGap)
+		y := collageGap + row*(cell+collageGap)
+		// Center the last row when it isn't full
+		if last := len(images) - row*cols; last < cols {
+			x += (cols - last) * (cell + collageGap) / 2
+		}
+		draw.CatmullRom.Scale(out, image.Rect(x, y, x+cell, y+cell), img, centerSquare(img.Bounds()), draw.Src, nil)
+	}
+	return out
+}
+
+// centerSquare returns the largest square in the center of r
+func centerSquare(r image.Rectangle) image.Rectangle {
+	if r.Dx() > r.Dy() {
+		x := r.Min.X + (r.Dx()-r.Dy())/2
+		return image.Rect(x, r.Min.Y, x+r.Dy(), r.Max.Y)
+	}
+	y := r.Min.Y + (r.Dy()-r.Dx())/2
+	return image.Rect(r.Min.X, y, r.Max.X, y+r.Dx())
+}
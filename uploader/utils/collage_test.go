@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCollageGrid(t *testing.T) {
+
+	grids := map[int][2]int{
+		2: {2, 1},
+		3: {2, 2},
+		4: {2, 2},
+		5: {3, 2},
+		6: {3, 2},
+		7: {3, 3},
+		9: {3, 3},
+	}
+	for n, expected := range grids {
+		cols, rows := CollageGrid(n)
+		if cols != expected[0] || rows != expected[1] {
+			t.Errorf("unexpected grid for %d photos: got %dx%d want %dx%d", n, cols, rows, expected[0], expected[1])
+		}
+	}
+}
+
+func TestCollage(t *testing.T) {
+
+	var images []image.Image
+	for i := 0; i < 12; i++ {
+		images = append(images, image.NewGray(image.Rect(0, 0, 40+i, 30)))
+	}
+
+	out := Collage(images, 100)
+	expected := 3*100 + 4*collageGap
+	if out.Bounds().Dx() != expected || out.Bounds().Dy() != expected {
+		t.Errorf("unexpected collage size: got %v want %dx%d", out.Bounds().Size(), expected, expected)
+	}
+}
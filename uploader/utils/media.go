@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Media kinds stored in the "kind" metadata of uploaded objects
+const (
+	MediaKindImage = "image"
+	MediaKindVideo = "video"
+	MediaKindAudio = "audio"
+)
+
+// MediaKind returns the kind of media for a content type,
+// or an empty string if the type isn't supported
+func MediaKind(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return MediaKindImage
+	case strings.HasPrefix(contentType, "video/"):
+		return MediaKindVideo
+	case strings.HasPrefix(contentType, "audio/"):
+		return MediaKindAudio
+	}
+	return ""
+}
+
+// ContentHash returns the hex encoded SHA-256 digest of a media file,
+// used as its object key so identical files are stored once
+func ContentHash(file []byte) string {
+	sum := sha256.Sum256(file)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	// Register decoders for the formats MMS photos arrive in
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// DecodeImage decodes an image file in any of the registered formats
+func DecodeImage(file []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(file))
+	return img, err
+}
+
+// DifferenceHash computes the 64 bit dHash of an image.
+// The image is reduced to a 9x8 grayscale thumbnail and each bit records
+// whether a pixel is brighter than its right-hand neighbour, so resized or
+// recompressed copies of a photo hash to the same or nearby values.
+func DifferenceHash(img image.Image) uint64 {
+	gray := grayThumbnail(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// FormatHash encodes a perceptual hash for storage in object metadata
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// grayThumbnail shrinks an image to w x h by averaging the luminance
+// of the pixels covered by each cell
+func grayThumbnail(img image.Image, w, h int) [][]float64 {
+	b := img.Bounds()
+	out := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		out[y] = make([]float64, w)
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum float64
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					sum += luminance(img, px, py)
+				}
+			}
+			out[y][x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+	return out
+}
+
+// luminance returns the perceived brightness of a pixel in the range 0-255
+func luminance(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
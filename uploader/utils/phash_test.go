@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+)
+
+// gradient returns a w x h image that gets brighter from left to right
+func gradient(w, h int, offset uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x*200/w) + offset})
+		}
+	}
+	return img
+}
+
+func TestDifferenceHash(t *testing.T) {
+
+	a := DifferenceHash(gradient(90, 80, 0))
+	b := DifferenceHash(gradient(900, 800, 20))
+	if d := bits.OnesCount64(a ^ b); d != 0 {
+		t.Errorf("resized and brightened copies differ by %d bits", d)
+	}
+
+	// Mirroring the gradient flips every comparison
+	mirrored := image.NewGray(image.Rect(0, 0, 90, 80))
+	src := gradient(90, 80, 0).(*image.Gray)
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 90; x++ {
+			mirrored.SetGray(x, y, src.GrayAt(89-x, y))
+		}
+	}
+	if d := bits.OnesCount64(a ^ DifferenceHash(mirrored)); d < 32 {
+		t.Errorf("mirrored image is only %d bits away", d)
+	}
+}
+
+func TestFormatHash(t *testing.T) {
+
+	if got := FormatHash(0xff); got != "00000000000000ff" {
+		t.Errorf("unexpected hash encoding: got %v want %v", got, "00000000000000ff")
+	}
+}
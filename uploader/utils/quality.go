@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"image"
+)
+
+// qualitySize is the longest side images are reduced to before scoring,
+// so scores are comparable between cameras and cheap to compute
+const qualitySize = 512
+
+// Quality describes how usable a photo looks
+type Quality struct {
+	// Sharpness is the variance of the Laplacian of the photo.
+	// Blurry photos have few edges and score low.
+	Sharpness float64
+	// Brightness is the mean luminance of the photo, from 0 to 255
+	Brightness float64
+	// Dark is the fraction of pixels that are nearly black
+	Dark float64
+}
+
+// MeasureQuality scores the sharpness and exposure of an image
+func MeasureQuality(img image.Image) Quality {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > qualitySize || h > qualitySize {
+		if w > h {
+			w, h = qualitySize, h*qualitySize/w
+		} else {
+			w, h = w*qualitySize/h, qualitySize
+		}
+	}
+	if w < 3 || h < 3 {
+		return Quality{}
+	}
+	gray := grayThumbnail(img, w, h)
+
+	// Exposure histogram
+	var histogram [256]int
+	var sum float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := gray[y][x]
+			histogram[int(v)]++
+			sum += v
+		}
+	}
+	var dark int
+	for _, n := range histogram[:32] {
+		dark += n
+	}
+	pixels := float64(w * h)
+
+	// Variance of the 4-neighbour Laplacian
+	var lsum, lsq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			l := gray[y-1][x] + gray[y+1][x] + gray[y][x-1] + gray[y][x+1] - 4*gray[y][x]
+			lsum += l
+			lsq += l * l
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := lsum / n
+
+	return Quality{
+		Sharpness:  lsq/n - mean*mean,
+		Brightness: sum / pixels,
+		Dark:       float64(dark) / pixels,
+	}
+}
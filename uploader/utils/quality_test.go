@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestMeasureQuality(t *testing.T) {
+
+	sharp := image.NewGray(image.Rect(0, 0, 64, 64))
+	blurry := image.NewGray(image.Rect(0, 0, 64, 64))
+	dark := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x/4+y/4)%2 == 0 {
+				sharp.SetGray(x, y, color.Gray{Y: 255})
+			}
+			blurry.SetGray(x, y, color.Gray{Y: uint8(100 + x)})
+			dark.SetGray(x, y, color.Gray{Y: 5})
+		}
+	}
+
+	s := MeasureQuality(sharp)
+	b := MeasureQuality(blurry)
+	if s.Sharpness <= b.Sharpness {
+		t.Errorf("sharp image scored %v, blurry image scored %v", s.Sharpness, b.Sharpness)
+	}
+
+	d := MeasureQuality(dark)
+	if d.Brightness > 10 || d.Dark != 1 {
+		t.Errorf("dark image scored brightness %v, dark fraction %v", d.Brightness, d.Dark)
+	}
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// UpdateSecret is the key shared with the updater that update requests
+// are signed with. Requests aren't signed when it's empty.
+var UpdateSecret string
+
+// Headers of a signed update request
+const (
+	SignatureHeader = "X-Update-Signature"
+	TimestampHeader = "X-Update-Timestamp"
+	NonceHeader     = "X-Update-Nonce"
+)
+
+// SignRequest signs a request and its body with secret. The signature
+// covers the method, path, body, a timestamp and a nonce, so the updater
+// can reject stale and replayed requests.
+func SignRequest(req *http.Request, body []byte, secret string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := xid.New().String()
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, "v1="+Signature(secret, timestamp, nonce, req.Method, req.URL.RequestURI(), body))
+}
+
+// Signature returns the hex HMAC-SHA256 of a request's signed fields
+func Signature(secret, timestamp, nonce, method, uri string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range []string{timestamp, nonce, method, uri, hex.EncodeToString(digest[:])} {
+		mac.Write([]byte(field))
+		mac.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSignature(t *testing.T) {
+	// The updater verifies requests with the same vector
+	got := Signature("secret", "1600000000", "nonce", "POST", "/update?wait=true", []byte(`{"added":["photos/a"]}`))
+	if expected := "0f0aa2de89dc2529a8ec83866becc6d1ebcf2b4b3c6d8168ed79c872cb1e5489"; got != expected {
+		t.Errorf("unexpected signature: got %s want %s", got, expected)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+
+	body := []byte(`{"added":["photos/a"]}`)
+	req, _ := http.NewRequest("POST", "http://updater:8080/update", nil)
+	SignRequest(req, body, "secret")
+
+	timestamp, nonce := req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader)
+	if timestamp == "" || nonce == "" {
+		t.Fatalf("request isn't timestamped: %v", req.Header)
+	}
+	expected := Signature("secret", timestamp, nonce, "POST", "/update", body)
+	if got := req.Header.Get(SignatureHeader); !strings.HasSuffix(got, expected) {
+		t.Errorf("unexpected signature: got %s want v1=%s", got, expected)
+	}
+}
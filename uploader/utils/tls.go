@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSFiles are the PEM files the uploader calls the updater with
+type TLSFiles struct {
+	// Cert and Key are the client certificate, for an updater that requires one
+	Cert string
+	Key  string
+	// CA verifies the updater's certificate. The system roots are used when it's empty.
+	CA string
+}
+
+// UpdateTLS holds the TLS files update requests use, if any
+var UpdateTLS *CertReloader
+
+// checkInterval is the least time between checks of the TLS files, so a
+// burst of update requests doesn't stat them for each one
+const checkInterval = time.Second
+
+// CertReloader makes the HTTP clients update requests are sent with. A new
+// client is made when the TLS files are rotated; until the rotated files
+// load, the last client that worked keeps being used.
+type CertReloader struct {
+	files TLSFiles
+
+	mu sync.Mutex
+	// version records the size and modification time of each file the
+	// client was made from
+	version string
+	client  *http.Client
+	// checked is when the files were last compared to version
+	checked time.Time
+}
+
+// NewCertReloader loads a set of TLS files
+func NewCertReloader(files TLSFiles) (*CertReloader, error) {
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, errors.New("a client certificate needs both a certificate and a key")
+	}
+	c := &CertReloader{files: files}
+	version, err := c.filesVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(version); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Client returns the HTTP client for the current files, making a new one
+// if they have changed since they were last checked
+func (c *CertReloader) Client() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < checkInterval {
+		return c.client
+	}
+	c.checked = time.Now()
+	version, err := c.filesVersion()
+	if err != nil {
+		log.Printf("Unable to check the update TLS files, keeping the current client: %s", err)
+		return c.client
+	}
+	if version != c.version {
+		previous := c.client
+		if err := c.load(version); err != nil {
+			log.Printf("Unable to load the rotated update TLS files, keeping the current client: %s", err)
+		} else {
+			log.Printf("Loaded the rotated update TLS files")
+			previous.CloseIdleConnections()
+		}
+	}
+	return c.client
+}
+
+// load reads the files, which are at version, and creates a client that
+// uses them. Must be called with c.mu held or before c is shared.
+func (c *CertReloader) load(version string) error {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.files.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.files.Cert, c.files.Key)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.files.CA != "" {
+		buf, err := ioutil.ReadFile(c.files.CA)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificates in %s", c.files.CA)
+		}
+	}
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+	c.version = version
+	return nil
+}
+
+// filesVersion describes the client certificate, key and CA files as they
+// are now
+func (c *CertReloader) filesVersion() (string, error) {
+	var version []string
+	for _, path := range []string{c.files.Cert, c.files.Key, c.files.CA} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		version = append(version, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(version, ","), nil
+}
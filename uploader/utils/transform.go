@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Transforms that can be applied to a published photo
+const (
+	TransformRotate90   = "rotate=90"
+	TransformRotate180  = "rotate=180"
+	TransformRotate270  = "rotate=270"
+	TransformCropSquare = "crop=square"
+)
+
+// ParseTransforms parses the "transform" metadata of a photo, a list of
+// transforms separated by ";"
+func ParseTransforms(s string) []string {
+	var transforms []string
+	for _, t := range strings.Split(s, ";") {
+		if t = strings.TrimSpace(t); t != "" {
+			transforms = append(transforms, t)
+		}
+	}
+	return transforms
+}
+
+// FormatTransforms encodes transforms for storage in object metadata
+func FormatTransforms(transforms []string) string {
+	return strings.Join(transforms, ";")
+}
+
+// ApplyTransforms applies transforms to an image in order
+func ApplyTransforms(img image.Image, transforms []string) (image.Image, error) {
+	for _, t := range transforms {
+		switch t {
+		case TransformRotate90:
+			img = rotate90(img)
+		case TransformRotate180:
+			img = rotate90(rotate90(img))
+		case TransformRotate270:
+			img = rotate90(rotate90(rotate90(img)))
+		case TransformCropSquare:
+			img = crop(img, centerSquare(img.Bounds()))
+		default:
+			return nil, fmt.Errorf("unknown transform %q", t)
+		}
+	}
+	return img, nil
+}
+
+// rotate90 rotates an image 90 degrees clockwise
+func rotate90(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.Set(b.Max.Y-1-y, x-b.Min.X, img.At(x, y))
+		}
+	}
+	return out
+}
+
+// crop returns the part of an image within r
+func crop(img image.Image, r image.Rectangle) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(out, out.Bounds(), img, r.Min, draw.Src)
+	return out
+}
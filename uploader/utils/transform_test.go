@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestApplyTransforms(t *testing.T) {
+
+	// A 4x2 image with a white pixel in the top left corner
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	img.SetGray(0, 0, color.Gray{Y: 255})
+
+	rotated, err := ApplyTransforms(img, []string{TransformRotate90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Bounds().Dx() != 2 || rotated.Bounds().Dy() != 4 {
+		t.Fatalf("rotated image has bounds %v", rotated.Bounds())
+	}
+	if r, _, _, _ := rotated.At(1, 0).RGBA(); r == 0 {
+		t.Errorf("top left corner wasn't rotated to the top right")
+	}
+
+	full, err := ApplyTransforms(img, []string{TransformRotate90, TransformRotate270})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := full.At(0, 0).RGBA(); r == 0 || full.Bounds().Dx() != 4 {
+		t.Errorf("rotating 90 and 270 degrees didn't restore the image")
+	}
+
+	square, err := ApplyTransforms(img, []string{TransformCropSquare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if square.Bounds().Dx() != 2 || square.Bounds().Dy() != 2 {
+		t.Errorf("cropped image has bounds %v", square.Bounds())
+	}
+
+	if _, err := ApplyTransforms(img, []string{"flip"}); err == nil {
+		t.Errorf("unknown transform was applied")
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+
+	transforms := ParseTransforms(" rotate=90;;crop=square ")
+	if len(transforms) != 2 || FormatTransforms(transforms) != "rotate=90;crop=square" {
+		t.Errorf("unexpected transforms: %v", transforms)
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,9 +10,11 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"strconv"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -23,6 +26,7 @@ import (
 func ExtractDict(m map[string][]string) (map[string]interface{}, error) {
 	dict := map[string]interface{}{}
 	mediaURLs := map[string]string{}
+	mediaContentTypes := map[string]string{}
 
 	// Convert dictionary to usable struct
 	for key, value := range m {
@@ -34,9 +38,13 @@ func ExtractDict(m map[string][]string) (map[string]interface{}, error) {
 			mediaURLs[key] = value[0]
 			continue
 		}
+		if strings.HasPrefix(key, "MediaContentType") {
+			mediaContentTypes[key] = value[0]
+		}
 		dict[key] = value[0]
 	}
 	dict["MediaURLs"] = mediaURLs
+	dict["MediaContentTypes"] = mediaContentTypes
 	return dict, nil
 }
 
@@ -109,17 +117,21 @@ func GetFileLocation(url string) (*FileLocation, error) {
 	return nil, errors.New("Unable to find the file location")
 }
 
-// GetFileBytes downloads the contents of a media file into a buffer
+// GetFileBytes downloads the contents of a media file into a buffer.
+// Files larger than MaxFileSize are rejected.
 func GetFileBytes(url string) ([]byte, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	buf, err := ioutil.ReadAll(resp.Body)
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxFileSize+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(buf)) > MaxFileSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", MaxFileSize)
+	}
 	return buf, nil
 }
 
@@ -173,6 +185,98 @@ func S3UploadFile(input *s3manager.UploadInput) error {
 	return nil
 }
 
+// S3HeadObject returns the metadata of an object, or nil if the object doesn't exist
+func S3HeadObject(bucket, key string) (*s3.HeadObjectOutput, error) {
+	svc := s3.New(session.New())
+	result, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// S3UpdateMetadata replaces the metadata of an object in place.
+// S3 metadata is immutable, so the object is copied onto itself.
+func S3UpdateMetadata(bucket, key string, head *s3.HeadObjectOutput, metadata map[string]*string) error {
+	svc := s3.New(session.New())
+	_, err := svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(bucket + "/" + key)),
+		ACL:               aws.String("public-read"),
+		ContentType:       head.ContentType,
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	return err
+}
+
+// S3GetObject downloads the contents of an object
+func S3GetObject(bucket, key string) ([]byte, error) {
+	svc := s3.New(session.New())
+	result, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	return ioutil.ReadAll(result.Body)
+}
+
+// S3ListKeys returns the keys of the objects under a prefix
+func S3ListKeys(bucket, prefix string) ([]string, error) {
+	svc := s3.New(session.New())
+	var keys []string
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// S3MoveObject moves an object to a new key within a bucket,
+// replacing its ACL and metadata
+func S3MoveObject(bucket, src, dst, acl string, metadata map[string]*string) error {
+	svc := s3.New(session.New())
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(dst),
+		CopySource:        aws.String(url.PathEscape(bucket + "/" + src)),
+		ACL:               aws.String(acl),
+		ContentType:       head.ContentType,
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(src),
+	})
+	return err
+}
+
 // IsWhiteListed determines if the sending number is allowed to post
 func IsWhiteListed(number string, allowed *[]string) bool {
 	for _, n := range *allowed {
@@ -183,21 +287,56 @@ func IsWhiteListed(number string, allowed *[]string) bool {
 	return false
 }
 
-// InvokeUpdate invokes the update API
-func InvokeUpdate(url string) error {
+// Update describes the photos changed since the last update, so the
+// updater only reads their metadata rather than the whole bucket
+type Update struct {
+	Added    []string `json:"added,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"`
+	// Message is the SID of the message that caused the changes, if any
+	Message string `json:"message,omitempty"`
+	// Full requests a rebuild from the whole bucket
+	Full bool `json:"full,omitempty"`
+}
+
+// InvokeUpdate invokes the update API. A nil update requests a full rebuild.
+// The request is signed when UpdateSecret is set, and uses UpdateTLS if it's set.
+func InvokeUpdate(url string, update *Update) error {
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, nil)
+	if UpdateTLS != nil {
+		client = UpdateTLS.Client()
+	}
+	var body []byte
+	if update != nil {
+		buf, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		body = buf
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
+	req.Header.Set("X-Trigger-Source", "uploader")
+	if update != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if UpdateSecret != "" {
+		SignRequest(req, body, UpdateSecret)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
 	log.Printf(string(buf))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("update failed: %s", resp.Status)
+	}
 	return nil
 }
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestInvokeUpdate(t *testing.T) {
+
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	update := &Update{Added: []string{"photos/a"}, Message: "MM1"}
+	if err := InvokeUpdate(srv.URL, update); err != nil {
+		t.Fatal(err)
+	}
+	if err := InvokeUpdate(srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := &Update{}
+	if err := json.Unmarshal(bodies[0], sent); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sent, update) {
+		t.Errorf("unexpected update: got %+v want %+v", sent, update)
+	}
+	if len(bodies[1]) != 0 {
+		t.Errorf("a full rebuild sent a body: %s", bodies[1])
+	}
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"net/http"
+	"strings"
+)
+
+// MaxFileSize is the most that will be downloaded for a single media file
+var MaxFileSize int64 = 100 << 20
+
+// MaxImagePixels is the largest image, in pixels, that will be decoded.
+// Dimensions are read from the header first, so a small file that
+// decompresses to a huge bitmap is rejected before it's decoded.
+var MaxImagePixels = 50000000
+
+// MediaSizeLimits is the largest accepted file for each content type.
+// Types that aren't listed are rejected.
+var MediaSizeLimits = map[string]int64{
+	"image/jpeg":      20 << 20,
+	"image/png":       20 << 20,
+	"image/gif":       10 << 20,
+	"video/mp4":       100 << 20,
+	"video/3gpp":      100 << 20,
+	"video/quicktime": 100 << 20,
+	"video/webm":      100 << 20,
+	"audio/amr":       10 << 20,
+	"audio/mp4":       10 << 20,
+	"audio/mpeg":      10 << 20,
+	"audio/ogg":       10 << 20,
+	"audio/wave":      10 << 20,
+}
+
+// markup is content that a browser could interpret as a document.
+// Videos and audio containing it are rejected, so polyglot files can never
+// be served as attacker-controlled pages from the public bucket. Images
+// aren't scanned, since CleanImage re-encodes them before they're published.
+var markup = [][]byte{
+	[]byte("<html"),
+	[]byte("<!doctype"),
+	[]byte("<script"),
+	[]byte("<iframe"),
+	[]byte("<svg"),
+	[]byte("<?xml"),
+	[]byte("<body"),
+	[]byte("<object"),
+	[]byte("<embed"),
+	[]byte("javascript:"),
+}
+
+// signatures identify the types that http.DetectContentType can't sniff,
+// or sniffs as another type sharing their container, such as M4A audio
+// sniffed as MP4 video. The offset is where the signature starts.
+var signatures = map[string]struct {
+	offset int
+	magic  []byte
+}{
+	"video/3gpp":      {4, []byte("ftyp3g")},
+	"video/quicktime": {4, []byte("ftypqt")},
+	"audio/amr":       {0, []byte("#!AMR")},
+	"audio/mp4":       {4, []byte("ftypM4A")},
+	"audio/ogg":       {0, []byte("OggS")},
+}
+
+// ValidatedMedia is a media file that passed validation
+type ValidatedMedia struct {
+	ContentType string
+	Kind        string
+	// Image is the decoded image, for image files
+	Image  image.Image
+	Width  int
+	Height int
+}
+
+// ValidateMedia checks that a media file is what it claims to be.
+// The declared type is the Content-Type reported by Twilio.
+func ValidateMedia(file []byte, declared string) (*ValidatedMedia, error) {
+	declared = strings.ToLower(strings.TrimSpace(strings.Split(declared, ";")[0]))
+	sniffed := strings.Split(http.DetectContentType(file), ";")[0]
+	if strings.HasPrefix(sniffed, "text/") {
+		return nil, fmt.Errorf("%s files aren't accepted", sniffed)
+	}
+
+	// The declared type is trusted when the file has its signature, so the
+	// container it shares with another type doesn't decide its kind
+	contentType := sniffed
+	if sig, ok := signatures[declared]; ok && hasSignature(file, sig.offset, sig.magic) {
+		contentType = declared
+	} else if sniffed == "application/octet-stream" {
+		return nil, fmt.Errorf("file doesn't look like %s", declared)
+	}
+
+	limit, ok := MediaSizeLimits[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%s files aren't accepted", contentType)
+	}
+	if int64(len(file)) > limit {
+		return nil, fmt.Errorf("%s files are limited to %d MB", contentType, limit>>20)
+	}
+	kind := MediaKind(contentType)
+	if declared != "" && MediaKind(declared) != kind {
+		return nil, fmt.Errorf("file was sent as %s but contains %s", declared, contentType)
+	}
+
+	v := &ValidatedMedia{
+		ContentType: contentType,
+		Kind:        kind,
+	}
+	if kind != MediaKindImage {
+		if containsMarkup(file) {
+			return nil, errors.New("file contains markup")
+		}
+		return v, nil
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("image can't be decoded: %s", err)
+	}
+	if "image/"+format != contentType {
+		return nil, fmt.Errorf("image is %s but contains %s", contentType, format)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > MaxImagePixels/config.Height {
+		return nil, fmt.Errorf("image dimensions %dx%d are too large", config.Width, config.Height)
+	}
+	v.Image, err = DecodeImage(file)
+	if err != nil {
+		return nil, fmt.Errorf("image can't be decoded: %s", err)
+	}
+	v.Width, v.Height = config.Width, config.Height
+	return v, nil
+}
+
+// hasSignature reports whether a file has magic at offset
+func hasSignature(file []byte, offset int, magic []byte) bool {
+	return len(file) >= offset+len(magic) && bytes.Equal(file[offset:offset+len(magic)], magic)
+}
+
+// containsMarkup reports whether a file contains HTML or script content
+func containsMarkup(file []byte) bool {
+	lower := bytes.ToLower(file)
+	for _, m := range markup {
+		if bytes.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanImage re-encodes a validated image from its pixels, so nothing else
+// in the file, such as markup appended after the image data, is published.
+// Every frame of an animated GIF is kept.
+func CleanImage(img image.Image, file []byte, contentType string) ([]byte, error) {
+	if contentType != "image/gif" {
+		return EncodeImage(img, contentType)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
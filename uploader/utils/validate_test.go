@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodeJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngBomb returns a tiny PNG whose header claims enormous dimensions
+func pngBomb(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// IHDR data starts after the 8 byte signature and the chunk length and type
+	binary.BigEndian.PutUint32(b[16:], 100000)
+	binary.BigEndian.PutUint32(b[20:], 100000)
+	binary.BigEndian.PutUint32(b[29:], crc32.ChecksumIEEE(b[12:29]))
+	return b
+}
+
+func TestValidateMedia(t *testing.T) {
+
+	photo := encodeJPEG(t)
+	v, err := ValidateMedia(photo, "image/jpeg")
+	if err != nil {
+		t.Fatalf("valid photo was rejected: %v", err)
+	}
+	if v.ContentType != "image/jpeg" || v.Width != 16 || v.Height != 16 || v.Image == nil {
+		t.Errorf("unexpected validation result: %+v", v)
+	}
+
+	video := append([]byte{0, 0, 0, 0x14}, []byte("ftyp3gp4\x00\x00\x00\x00")...)
+	if v, err := ValidateMedia(video, "video/3gpp"); err != nil || v.Kind != MediaKindVideo {
+		t.Errorf("3gpp video was rejected: %v", err)
+	}
+	memo := append([]byte{0, 0, 0, 0x20}, []byte("ftypM4A \x00\x00\x00\x00M4A mp42isom\x00\x00\x00\x00")...)
+	if v, err := ValidateMedia(memo, "audio/mp4"); err != nil || v.ContentType != "audio/mp4" || v.Kind != MediaKindAudio {
+		t.Errorf("M4A voice memo was rejected: %+v, %v", v, err)
+	}
+	ogg := []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00")
+	if v, err := ValidateMedia(ogg, "audio/ogg"); err != nil || v.Kind != MediaKindAudio {
+		t.Errorf("Ogg audio was rejected: %+v, %v", v, err)
+	}
+
+	rejected := map[string]struct {
+		file     []byte
+		declared string
+	}{
+		"html":              {[]byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), "image/jpeg"},
+		"svg":               {[]byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`), "image/svg+xml"},
+		"polyglot":          {append(append([]byte(nil), video...), []byte("<script>alert(1)</script>")...), "video/3gpp"},
+		"bomb":              {pngBomb(t), "image/png"},
+		"truncated":         {photo[:len(photo)/2], "image/jpeg"},
+		"wrong kind":        {photo, "audio/amr"},
+		"unknown binary":    {[]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, "application/zip"},
+		"fake signature":    {[]byte("not really a video file"), "video/3gpp"},
+		"unsupported image": {[]byte("BM\x00\x00\x00\x00\x00\x00"), "image/bmp"},
+	}
+	for name, c := range rejected {
+		if _, err := ValidateMedia(c.file, c.declared); err == nil {
+			t.Errorf("%s file was accepted", name)
+		}
+	}
+}
+
+func TestCleanImagePolyglot(t *testing.T) {
+
+	polyglot := append(encodeJPEG(t), []byte("<script>alert(1)</script>")...)
+	v, err := ValidateMedia(polyglot, "image/jpeg")
+	if err != nil {
+		t.Fatalf("photo with trailing data was rejected: %v", err)
+	}
+	clean, err := CleanImage(v.Image, polyglot, v.ContentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsMarkup(clean) {
+		t.Errorf("markup survived cleaning")
+	}
+	if _, err := ValidateMedia(clean, "image/jpeg"); err != nil {
+		t.Errorf("cleaned photo is invalid: %v", err)
+	}
+
+	// Animated GIFs keep their frames
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	animation := append(buf.Bytes(), []byte("<html>")...)
+	clean, err = CleanImage(nil, animation, "image/gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 || containsMarkup(clean) {
+		t.Errorf("cleaned GIF has %d frames", len(g.Image))
+	}
+}
+
+func TestValidateMediaSizeLimit(t *testing.T) {
+
+	limit := MediaSizeLimits["image/jpeg"]
+	defer func() { MediaSizeLimits["image/jpeg"] = limit }()
+	MediaSizeLimits["image/jpeg"] = 10
+
+	if _, err := ValidateMedia(encodeJPEG(t), "image/jpeg"); err == nil {
+		t.Errorf("oversized photo was accepted")
+	}
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultAlbum is the album of photos without an album hashtag.
+// Its watermark settings also apply to albums that don't have their own.
+const DefaultAlbum = "default"
+
+// Watermark describes the watermark applied to an album's public photos
+type Watermark struct {
+	// Text is drawn when set
+	Text string `json:"text,omitempty"`
+	// Image is the path of a PNG drawn instead of Text
+	Image string `json:"image,omitempty"`
+	// Position is one of top-left, top-right, bottom-left, bottom-right or center
+	Position string `json:"position,omitempty"`
+	// Opacity ranges from 0 (invisible) to 1 (opaque)
+	Opacity float64 `json:"opacity,omitempty"`
+	// Scale is the width of the watermark as a fraction of the photo's width
+	Scale float64 `json:"scale,omitempty"`
+
+	mark image.Image
+}
+
+// WatermarkConfig maps album names to their watermark settings
+type WatermarkConfig map[string]*Watermark
+
+// LoadWatermarkConfig reads watermark settings from a JSON file
+// and loads any watermark images
+func LoadWatermarkConfig(filename string) (WatermarkConfig, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := WatermarkConfig{}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %q, %v", filename, err)
+	}
+	for album, wm := range config {
+		if err := wm.load(); err != nil {
+			return nil, fmt.Errorf("album %s: %v", album, err)
+		}
+	}
+	return config, nil
+}
+
+// For returns the watermark of an album, or nil if its photos aren't watermarked
+func (c WatermarkConfig) For(album string) *Watermark {
+	if wm, ok := c[album]; ok {
+		return wm
+	}
+	return c[DefaultAlbum]
+}
+
+// load validates the settings and renders the watermark image
+func (wm *Watermark) load() error {
+	if wm.Opacity <= 0 || wm.Opacity > 1 {
+		wm.Opacity = 0.5
+	}
+	if wm.Scale <= 0 || wm.Scale > 1 {
+		wm.Scale = 0.25
+	}
+	switch wm.Position {
+	case "":
+		wm.Position = "bottom-right"
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+	default:
+		return fmt.Errorf("unknown position %q", wm.Position)
+	}
+
+	if wm.Image != "" {
+		f, err := os.Open(wm.Image)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		wm.mark, err = png.Decode(f)
+		return err
+	}
+	if wm.Text == "" {
+		return fmt.Errorf("watermark has neither text nor image")
+	}
+	wm.mark = renderText(wm.Text)
+	return nil
+}
+
+// renderText draws text in white on a transparent background
+func renderText(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	img := image.NewRGBA(image.Rect(0, 0, width+2, face.Height+2))
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.White),
+		Face: face,
+		Dot:  fixed.P(1, face.Ascent+1),
+	}
+	d.DrawString(text)
+	return img
+}
+
+// Apply returns a copy of img with the watermark drawn on it
+func (wm *Watermark) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	mb := wm.mark.Bounds()
+	w := int(float64(b.Dx()) * wm.Scale)
+	h := mb.Dy() * w / mb.Dx()
+	if w < 1 || h < 1 {
+		return out
+	}
+	margin := b.Dx() / 50
+	var x, y int
+	switch wm.Position {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = b.Dx()-w-margin, margin
+	case "bottom-left":
+		x, y = margin, b.Dy()-h-margin
+	case "center":
+		x, y = (b.Dx()-w)/2, (b.Dy()-h)/2
+	default:
+		x, y = b.Dx()-w-margin, b.Dy()-h-margin
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), wm.mark, mb, draw.Src, nil)
+	mask := image.NewUniform(color.Alpha{A: uint8(wm.Opacity * 255)})
+	draw.DrawMask(out, image.Rect(x, y, x+w, y+h), scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	return out
+}
+
+// EncodeImage encodes an image in the format of contentType
+func EncodeImage(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch contentType {
+	case "image/png":
+		err = png.Encode(&buf, img)
+	case "image/gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+	return buf.Bytes(), err
+}
+
+// AlbumOf returns the album named by the first hashtag in a caption
+func AlbumOf(caption string) string {
+	for _, word := range strings.Fields(caption) {
+		if strings.HasPrefix(word, "#") {
+			album := strings.ToLower(strings.Trim(word, "#.,!?"))
+			if album != "" {
+				return album
+			}
+		}
+	}
+	return DefaultAlbum
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAlbumOf(t *testing.T) {
+
+	captions := map[string]string{
+		"Bears at the lake #Camping2020": "camping2020",
+		"#family, at grandma's":          "family",
+		"No album here":                  DefaultAlbum,
+		"# not a tag":                    DefaultAlbum,
+	}
+	for caption, expected := range captions {
+		if got := AlbumOf(caption); got != expected {
+			t.Errorf("unexpected album for %q: got %v want %v", caption, got, expected)
+		}
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+
+	wm := &Watermark{Text: "photos.czan.io", Opacity: 1, Scale: 0.5}
+	if err := wm.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 200, 100))
+	out := wm.Apply(img)
+
+	if out.Bounds().Dx() != 200 || out.Bounds().Dy() != 100 {
+		t.Fatalf("watermarked image has bounds %v", out.Bounds())
+	}
+	if r, _, _, _ := out.At(5, 5).RGBA(); r != 0 {
+		t.Errorf("watermark was drawn outside its position")
+	}
+	var marked bool
+	for y := 50; y < 100 && !marked; y++ {
+		for x := 100; x < 200; x++ {
+			if c := color.GrayModel.Convert(out.At(x, y)).(color.Gray); c.Y > 0 {
+				marked = true
+				break
+			}
+		}
+	}
+	if !marked {
+		t.Errorf("watermark wasn't drawn in the bottom right corner")
+	}
+	if r, _, _, _ := img.At(150, 90).RGBA(); r != 0 {
+		t.Errorf("original image was modified")
+	}
+}
+
+func TestWatermarkConfigFor(t *testing.T) {
+
+	family := &Watermark{Text: "family"}
+	config := WatermarkConfig{"family": family}
+	if config.For("family") != family {
+		t.Errorf("album watermark wasn't used")
+	}
+	if config.For("travel") != nil {
+		t.Errorf("album without a watermark was watermarked")
+	}
+
+	fallback := &Watermark{Text: "default"}
+	config[DefaultAlbum] = fallback
+	if config.For("travel") != fallback {
+		t.Errorf("default watermark wasn't used")
+	}
+}